@@ -0,0 +1,451 @@
+package easycache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides how often the append-only file is fsynced
+type SyncPolicy uint32
+
+const (
+	// SyncEverySecond flushes and fsyncs the file once a second, a crash loses about one second of writes
+	SyncEverySecond = SyncPolicy(0)
+	// SyncAlways fsyncs the file on every write, the slowest and the safest
+	SyncAlways = SyncPolicy(1)
+	// SyncNever flushes the file once a second and leaves fsync to the OS
+	SyncNever = SyncPolicy(2)
+)
+
+const (
+	defaultAOFRewriteSize = 64 << 20 // 64MB
+	aofHeaderSize         = 8        // [uint32 length][uint32 crc32]
+)
+
+type aofOp uint8
+
+const (
+	aofSet = aofOp(1) // the key is set to Entry
+	aofDel = aofOp(2) // the key is removed
+)
+
+// aofRecord is an operation in the append-only file, a set record holds the whole state of the key
+// so that replaying a key more than once is harmless
+type aofRecord[K comparable, V any] struct {
+	Op    aofOp
+	Entry snapshotEntry[K, V]
+}
+
+// aof appends the writes of the shards to Config.AOFPath, and rewrites it from the shards when it grows too large
+type aof[K comparable, V any] struct {
+	lock   sync.Mutex
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	stream *aofStream[K, V] // of the file
+	codec  Codec
+	sync   SyncPolicy
+	logger Logger
+
+	size        int64 // bytes in the file
+	rewriteSize int64 // size to start the next rewrite
+	minRewrite  int64 // Config.AOFRewriteSize
+
+	// the records of the shards already copied by the rewrite, they are written to the new file after the shards
+	rewriting bool
+	copied    []bool // by shard id
+	pending   []aofRecord[K, V]
+
+	shards  []*cacheShard[K, V]
+	closed  bool
+	close   chan struct{}
+	running sync.WaitGroup // flush loop and rewrite
+}
+
+// openAOF rewrites Config.AOFPath from the shards and appends to it. The path only exists once it is complete,
+// so that a snapshot is still loaded after a failure or a crash in the middle.
+func openAOF[K comparable, V any](conf CacheConfig[K, V], codec Codec, shards []*cacheShard[K, V]) (*aof[K, V], error) {
+	minRewrite := conf.AOFRewriteSize
+	if minRewrite <= 0 {
+		minRewrite = defaultAOFRewriteSize
+	}
+	a := &aof[K, V]{
+		path:       conf.AOFPath,
+		w:          bufio.NewWriter(nil),
+		codec:      codec,
+		sync:       conf.AOFSync,
+		logger:     newLogger(conf.Logger),
+		minRewrite: minRewrite,
+		shards:     shards,
+		copied:     make([]bool, len(shards)),
+		close:      make(chan struct{}),
+	}
+	// the replayed k/v, or a loaded snapshot, are the whole file from now on
+	if err := a.compact(); err != nil {
+		return nil, err
+	}
+
+	if a.sync != SyncAlways {
+		a.running.Add(1)
+		go a.flushLoop()
+	}
+	return a, nil
+}
+
+// aofStream encodes all the records of a file with one encoder, so that the state of the codec (e.g. gob types) is written once
+type aofStream[K comparable, V any] struct {
+	buf bytes.Buffer
+	enc Encoder
+}
+
+func newAOFStream[K comparable, V any](codec Codec) *aofStream[K, V] {
+	s := &aofStream[K, V]{}
+	s.enc = codec.NewEncoder(&s.buf)
+	return s
+}
+
+// encode frames a record as [uint32 length][uint32 crc32][payload], the data is valid until the next call.
+// The data must be written even with an error, the encoder may have written its state before failing.
+func (s *aofStream[K, V]) encode(record aofRecord[K, V]) ([]byte, error) {
+	var header [aofHeaderSize]byte
+	s.buf.Reset()
+	s.buf.Write(header[:])
+	err := s.enc.Encode(record)
+	data := s.buf.Bytes()
+	if len(data) == aofHeaderSize {
+		return nil, err
+	}
+	payload := data[aofHeaderSize:]
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	return data, err
+}
+
+// append writes the record of the shard, it is called with the shard lock held so the records of a key are in order
+func (a *aof[K, V]) append(shard int, record aofRecord[K, V]) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return
+	}
+	if err := a.writeRecord(record); err != nil {
+		a.logger.Printf("aof %s: key <%v>: %v\n", a.path, record.Entry.Key, err)
+		if record.Op != aofSet {
+			return
+		}
+		// the value it overwrote must not be replayed, the key is missing after a restart instead
+		record = aofRecord[K, V]{Op: aofDel, Entry: snapshotEntry[K, V]{Key: record.Entry.Key}}
+		if err := a.writeRecord(record); err != nil {
+			a.logger.Printf("aof %s: key <%v>: %v\n", a.path, record.Entry.Key, err)
+			return
+		}
+	}
+	if a.rewriting {
+		if a.copied[shard] {
+			a.pending = append(a.pending, record)
+		}
+	} else if a.size >= a.rewriteSize {
+		a.rewriting = true
+		a.running.Add(1)
+		go a.rewrite()
+	}
+}
+
+// writeRecord encodes and writes the record, must hold the lock
+func (a *aof[K, V]) writeRecord(record aofRecord[K, V]) error {
+	data, encErr := a.stream.encode(record)
+	if len(data) > 0 { // the state of the codec is written even with an error
+		if err := a.write(data); err != nil {
+			return err
+		}
+	}
+	return encErr
+}
+
+// write must hold the lock
+func (a *aof[K, V]) write(data []byte) error {
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+	a.size += int64(len(data))
+	if a.sync == SyncAlways {
+		return a.flush()
+	}
+	return nil
+}
+
+// flush writes the buffer to the file and fsyncs it unless SyncNever, must hold the lock.
+// Only SyncAlways fsyncs under the lock, writers wait for the disk then anyway.
+func (a *aof[K, V]) flush() error {
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if a.sync == SyncNever {
+		return nil
+	}
+	return a.file.Sync()
+}
+
+// flushLoop flushes the file every second until the aof is closed
+func (a *aof[K, V]) flushLoop() {
+	defer a.running.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.flushFile(); err != nil {
+				a.logger.Printf("aof %s: %v\n", a.path, err)
+			}
+		case <-a.close:
+			return
+		}
+	}
+}
+
+// flushFile writes the buffer to the file under the lock, and fsyncs it outside so that writers of all shards are not stalled
+func (a *aof[K, V]) flushFile() error {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	err := a.w.Flush()
+	file := a.file
+	a.lock.Unlock()
+
+	if err != nil || a.sync == SyncNever {
+		return err
+	}
+	// the file may be replaced and closed by a rewrite meanwhile, the new one is synced by it
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// nextRewrite is twice the size of the file after a rewrite, and Config.AOFRewriteSize at least
+func (a *aof[K, V]) nextRewrite() int64 {
+	if a.size*2 > a.minRewrite {
+		return a.size * 2
+	}
+	return a.minRewrite
+}
+
+// rewrite compacts the file in the background
+func (a *aof[K, V]) rewrite() {
+	defer a.running.Done()
+	if err := a.compact(); err != nil {
+		a.logger.Printf("aof %s: rewrite: %v\n", a.path, err)
+	}
+}
+
+// compact writes the live k/v of the shards to a new file, then the records appended meanwhile, and renames it over the old one.
+// Deleted keys are gone from the shards, so the file holds no records of them any more.
+func (a *aof[K, V]) compact() error {
+	err := a.rewriteFile()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.rewriting = false
+	a.pending = nil
+	for i := range a.copied {
+		a.copied[i] = false
+	}
+	a.rewriteSize = a.nextRewrite()
+	return err
+}
+
+func (a *aof[K, V]) rewriteFile() error {
+	// a unique name, another process may be rewriting the same path
+	f, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*.rewrite")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	stream := newAOFStream[K, V](a.codec)
+	var size int64
+	writeRecord := func(record aofRecord[K, V]) error {
+		data, encErr := stream.encode(record)
+		if encErr != nil {
+			a.logger.Printf("aof %s: encode key <%v>: %v\n", a.path, record.Entry.Key, encErr)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		size += int64(len(data))
+		return nil
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	// a shard is copied under its lock, the later writes of the shard are in pending
+	for i, shard := range a.shards {
+		copied := func() {
+			a.lock.Lock()
+			a.copied[i] = true
+			a.lock.Unlock()
+		}
+		for _, entry := range shard.snapshot(time.Now(), copied) {
+			if err := writeRecord(aofRecord[K, V]{Op: aofSet, Entry: entry}); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	// most of the file is synced before blocking the writers
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, record := range a.pending {
+		if err := writeRecord(record); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := a.w.Flush(); err != nil { // the old file stays usable if the rename fails, the new one has all its records
+		return fail(err)
+	}
+	if err := os.Rename(f.Name(), a.path); err != nil {
+		return fail(err)
+	}
+
+	// f was opened for writing at the end of the file, go on appending to it
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = f
+	a.w.Reset(f)
+	a.stream = stream
+	a.size = size
+	return nil
+}
+
+// closeFile stops appending and waits for the background goroutines, then flushes and closes the file
+func (a *aof[K, V]) closeFile() error {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.close)
+	a.lock.Unlock()
+
+	a.running.Wait() // a rewrite in progress is finished
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := a.w.Flush()
+	if syncErr := a.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replayAOF applies Config.AOFPath to the shards, a missing file is an empty log.
+// A truncated or corrupted last record is left by a crash in the middle of a write, it is skipped.
+func (c *Cache[K, V]) replayAOF() error {
+	f, err := os.Open(c.conf.AOFPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := &aofReader{r: bufio.NewReader(f), size: info.Size()}
+	dec := c.codec().NewDecoder(r)
+	for {
+		var record aofRecord[K, V]
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) { // the end, or the state of a record which was not written
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record before offset %d: %w", r.offset, err)
+		}
+		hashedKey := c.hash.Sum64(record.Entry.Key)
+		shard := c.getShard(hashedKey)
+		if err := shard.replay(record, time.Now()); err != nil && !errors.Is(err, ErrEntryTooLarge) {
+			return err
+		}
+	}
+}
+
+// aofReader reads the payloads of the frames as one stream for the decoder, it ends before a truncated or corrupted last frame
+type aofReader struct {
+	r       *bufio.Reader
+	size    int64 // of the file
+	offset  int64 // end of the frames read
+	payload []byte
+}
+
+func (r *aofReader) Read(p []byte) (int, error) {
+	for len(r.payload) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.payload)
+	r.payload = r.payload[n:]
+	return n, nil
+}
+
+func (r *aofReader) next() error {
+	var header [aofHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) { // truncated
+			return io.EOF
+		}
+		return err
+	}
+	end := r.offset + aofHeaderSize + int64(binary.LittleEndian.Uint32(header[0:4]))
+	if end > r.size { // truncated
+		return io.EOF
+	}
+	payload := make([]byte, end-r.offset-aofHeaderSize)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		if end == r.size { // the last record
+			return io.EOF
+		}
+		return fmt.Errorf("corrupted record at offset %d", r.offset)
+	}
+	r.payload = payload
+	r.offset = end
+	return nil
+}
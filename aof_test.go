@@ -0,0 +1,266 @@
+package easycache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAOF(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.AOFPath = filepath.Join(t.TempDir(), "cache.aof")
+	conf.AOFSync = SyncAlways
+	cache, err := New(conf)
+	noError(t, err)
+	cache.Set("persist", "value", 0)
+	cache.Set("ttl", snapshotUser{"bob", 20}, time.Minute)
+	cache.Set("deleted", "value", 0)
+	cache.Delete("deleted")
+	cache.Set("expired", "value", time.Hour)
+	cache.Expire("expired", 20*time.Millisecond)
+	cache.Set("persisted", "value", 20*time.Millisecond)
+	cache.Persist("persisted")
+	cache.Set("expireNow", "value", 0)
+	cache.Expire("expireNow", -1)
+	cache.Set("counter", int64(1), 0)
+	cache.Incr("counter", 0)
+	cache.SetSliding("session", "data", time.Hour)
+	time.Sleep(30 * time.Millisecond)
+
+	// crash: reopen without Close
+	restored, err := New(conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, 5, restored.Count())
+	assertEqual(t, "value", mustGet(t, restored, "persist"))
+	assertEqual(t, snapshotUser{"bob", 20}, mustGet(t, restored, "ttl"))
+	assertEqual(t, "value", mustGet(t, restored, "persisted"))
+	assertEqual(t, int64(2), mustGet(t, restored, "counter"))
+	assertEqual(t, "data", mustGet(t, restored, "session"))
+	assertEqual(t, false, restored.Exists("deleted"))
+	assertEqual(t, false, restored.Exists("expired"))
+	assertEqual(t, false, restored.Exists("expireNow"))
+
+	ttl, _ := restored.TTL("ttl")
+	assertEqual(t, true, ttl > 59*time.Second && ttl < time.Minute-20*time.Millisecond)
+	ttl, _ = restored.TTL("persisted")
+	assertEqual(t, time.Duration(0), ttl)
+	ttl, _ = restored.TTL("session")
+	assertEqual(t, true, ttl > 59*time.Minute)
+	cache.Close()
+}
+
+func TestAOFEncodeError(t *testing.T) {
+	t.Parallel()
+
+	type unregistered struct{ X int }
+	conf := DefaultConfig()
+	conf.AOFPath = filepath.Join(t.TempDir(), "cache.aof")
+	conf.AOFSync = SyncAlways
+	conf.Logger = &recordLogger{}
+	cache, _ := New(conf)
+	defer cache.Close()
+	cache.Set("k", "old", 0)
+	cache.Set("k", unregistered{1}, 0) // gob can not encode it
+	cache.Set("after", "value", 0)
+
+	// crash: reopen without Close
+	restored, err := New(conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, false, restored.Exists("k")) // not the overwritten value
+	assertEqual(t, "value", mustGet(t, restored, "after"))
+}
+
+func TestAOFTruncated(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultCacheConfig[string, int]()
+	conf.AOFPath = filepath.Join(t.TempDir(), "cache.aof")
+	cache, _ := NewCache[string, int](conf)
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	noError(t, cache.Close())
+
+	// a crash in the middle of the last record
+	f, err := os.OpenFile(conf.AOFPath, os.O_WRONLY|os.O_APPEND, 0)
+	noError(t, err)
+	f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, 5})
+	f.Close()
+
+	restored, err := NewCache[string, int](conf)
+	noError(t, err)
+	assertEqual(t, 2, restored.Count())
+	restored.Set("c", 3, 0)
+	noError(t, restored.Close())
+
+	// the garbage was truncated, so the records after it are read
+	restored, err = NewCache[string, int](conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, 3, restored.Count())
+	val, err := restored.Get("c")
+	noError(t, err)
+	assertEqual(t, 3, val)
+
+	// a corrupted record in the middle is an error
+	data, err := os.ReadFile(conf.AOFPath)
+	noError(t, err)
+	data[aofHeaderSize] ^= 0xff // the first record
+	noError(t, os.WriteFile(conf.AOFPath, data, 0644))
+	if _, err := NewCache[string, int](conf); err == nil {
+		t.Fatal("expect an error for a corrupted record")
+	}
+}
+
+func TestAOFRecordSize(t *testing.T) {
+	t.Parallel()
+
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		conf := DefaultCacheConfig[string, int]()
+		conf.AOFPath = filepath.Join(t.TempDir(), "cache.aof")
+		conf.AOFSync = SyncAlways
+		conf.Codec = codec
+		cache, _ := NewCache[string, int](conf)
+		cache.Set("k", 0, 0)
+		info, err := os.Stat(conf.AOFPath)
+		noError(t, err)
+		first := info.Size()
+
+		// the types are written once a file
+		for i := 1; i <= 100; i++ {
+			cache.Set("k", i, 0)
+		}
+		info, err = os.Stat(conf.AOFPath)
+		noError(t, err)
+		assertEqual(t, true, (info.Size()-first)/100 < 128)
+		cache.Close()
+
+		restored, err := NewCache[string, int](conf)
+		noError(t, err)
+		val, _ := restored.Get("k")
+		assertEqual(t, 100, val)
+		restored.Close()
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultCacheConfig[string, int]()
+	conf.Shards = 4
+	conf.AOFPath = filepath.Join(t.TempDir(), "cache.aof")
+	conf.AOFRewriteSize = 16 << 10
+	cache, _ := NewCache[string, int](conf)
+	for i := 0; i < 10000; i++ {
+		cache.Set("key", i, 0)
+		cache.Set("other", -i, 0)
+	}
+	noError(t, cache.Close())
+
+	info, err := os.Stat(conf.AOFPath)
+	noError(t, err)
+	assertEqual(t, true, info.Size() < 2*conf.AOFRewriteSize)
+	rewrites, _ := filepath.Glob(conf.AOFPath + ".*.rewrite")
+	assertEqual(t, 0, len(rewrites))
+
+	restored, err := NewCache[string, int](conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, 2, restored.Count())
+	val, _ := restored.Get("key")
+	assertEqual(t, 9999, val)
+	val, _ = restored.Get("other")
+	assertEqual(t, -9999, val)
+}
+
+func TestAOFWithSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	conf := DefaultCacheConfig[string, int]()
+	conf.Shards = 4
+	conf.SnapshotPath = filepath.Join(dir, "cache.snapshot")
+	conf.AOFPath = filepath.Join(dir, "cache.aof")
+	conf.AOFSync = SyncAlways
+	conf.AOFRewriteSize = 4 << 10
+	cache, _ := NewCache[string, int](conf)
+	cache.Set("victim", 1, 0)
+	noError(t, cache.Close()) // the snapshot holds victim
+
+	cache, err := NewCache[string, int](conf)
+	noError(t, err)
+	noError(t, cache.Delete("victim"))
+	for i := 0; i < 1000; i++ { // rewrites drop the records of victim
+		cache.Set("churn", i, 0)
+	}
+
+	// crash: reopen without Close
+	restored, err := NewCache[string, int](conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, false, restored.Exists("victim"))
+	val, _ := restored.Get("churn")
+	assertEqual(t, 999, val)
+	cache.Close()
+
+	// a snapshot seeds a new append-only file
+	snapshotOnly := DefaultCacheConfig[string, int]()
+	snapshotOnly.SnapshotPath = filepath.Join(dir, "seed.snapshot")
+	seed, _ := NewCache[string, int](snapshotOnly)
+	seed.Set("seed", 1, 0)
+	noError(t, seed.Close())
+
+	snapshotOnly.AOFPath = filepath.Join(dir, "seed.aof")
+	snapshotOnly.AOFSync = SyncAlways
+	seed, err = NewCache[string, int](snapshotOnly)
+	noError(t, err)
+	seed.Set("new", 2, 0)
+	noError(t, os.Remove(snapshotOnly.SnapshotPath))
+
+	restored, err = NewCache[string, int](snapshotOnly)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, true, restored.Exists("seed"))
+	assertEqual(t, true, restored.Exists("new"))
+	seed.Close()
+}
+
+func TestAOFEmptyWithSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	conf := DefaultCacheConfig[string, int]()
+	conf.SnapshotPath = filepath.Join(dir, "cache.snapshot")
+	cache, _ := NewCache[string, int](conf)
+	cache.Set("a", 1, 0)
+	noError(t, cache.Close())
+
+	// an empty file left behind does not hide the snapshot
+	conf.AOFPath = filepath.Join(dir, "cache.aof")
+	noError(t, os.WriteFile(conf.AOFPath, nil, 0644))
+	restored, err := NewCache[string, int](conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, true, restored.Exists("a"))
+}
+
+func TestAOFSyncEverySecond(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultCacheConfig[string, int]()
+	conf.AOFPath = filepath.Join(t.TempDir(), "cache.aof")
+	cache, _ := NewCache[string, int](conf)
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	time.Sleep(1200 * time.Millisecond) // flushed by the background loop
+
+	// crash: reopen without Close
+	restored, err := NewCache[string, int](conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, true, restored.Exists("a"))
+}
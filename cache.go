@@ -1,7 +1,13 @@
 package easycache
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/gofish2020/easycache/utils"
@@ -11,120 +17,542 @@ const (
 	defaultCap = 32
 )
 
-type Getter interface {
-	Get(string) (interface{}, error)
-}
-
-type GetterFunc func(string) (interface{}, error)
-
-func (g GetterFunc) Get(key string) (interface{}, error) {
-	return g(key)
-}
-
-type EasyCache struct {
-	shards    []*cacheShard
-	hash      Hasher
-	conf      Config
+// Cache is a type-safe cache, keys are hashed by CacheConfig.Hasher to shards
+type Cache[K comparable, V any] struct {
+	shards    []*cacheShard[K, V]
+	hash      KeyHasher[K]
+	conf      CacheConfig[K, V]
 	shardMask uint64 // mask
+	janitors  []*janitor[K, V]
+	events    *hub[K, V] // subscribers
+
+	snapshotLock sync.Mutex // one snapshot file is written at a time
+	snapshotDone bool       // the last snapshot is saved by Close
+	aof          *aof[K, V] // nil if Config.AOFPath is empty
 
 	close chan struct{}
 }
 
-// New initialize new instance of EasyCache
-func New(conf Config) (*EasyCache, error) {
+// NewCache initialize new instance of Cache[K, V]
+func NewCache[K comparable, V any](conf CacheConfig[K, V]) (*Cache[K, V], error) {
 
 	if !utils.IsPowerOfTwo(conf.Shards) {
 		return nil, errors.New("shards number must be power of two")
 	}
 
-	if conf.Cap <= 0 {
+	if conf.Hasher == nil {
+		conf.Hasher = defaultKeyHasher[K]()
+		if conf.Hasher == nil {
+			return nil, errors.New("hasher is required for non-string keys")
+		}
+	}
+
+	if conf.Cap <= 0 && conf.MaxBytes <= 0 {
 		conf.Cap = defaultCap
 	}
+
+	if conf.Weigher == nil && conf.MaxBytes > 0 {
+		conf.Weigher = defaultWeigher[K, V]
+	}
+
+	if conf.Janitors <= 0 {
+		conf.Janitors = defaultJanitors
+	}
+	if conf.Janitors > conf.Shards {
+		conf.Janitors = conf.Shards
+	}
 	// init cache object
-	cache := &EasyCache{
-		shards:    make([]*cacheShard, conf.Shards),
+	cache := &Cache[K, V]{
+		shards:    make([]*cacheShard[K, V], conf.Shards),
 		conf:      conf,
 		hash:      conf.Hasher,
 		shardMask: uint64(conf.Shards - 1), // mask
+		janitors:  make([]*janitor[K, V], conf.Janitors),
 		close:     make(chan struct{}),
+		events:    newHub[K, V](),
+	}
+
+	var onRemoval RemovalListener[K, V]
+	switch {
+	case conf.OnRemoveWithReason != nil && conf.OnRemoval != nil:
+		onRemove, listener := conf.OnRemoveWithReason, conf.OnRemoval
+		onRemoval = func(event RemovalEvent[K, V]) {
+			onRemove(event.Key, event.Value, event.Reason)
+			listener(event)
+		}
+	case conf.OnRemoveWithReason != nil:
+		onRemoval = conf.OnRemoveWithReason.Listener()
+	case conf.OnRemoval != nil:
+		onRemoval = conf.OnRemoval
+	default:
+		onRemoval = cache.notProvidedOnRemoval
 	}
 
-	var onRemove OnRemoveCallback
-	if conf.OnRemoveWithReason != nil {
-		onRemove = conf.OnRemoveWithReason
-	} else {
-		onRemove = cache.notProvidedOnRemove
+	var removals *dispatcher[K, V]
+	if conf.RemovalWorkers > 0 && (conf.OnRemoveWithReason != nil || conf.OnRemoval != nil) {
+		removals = newDispatcher(conf, onRemoval, cache.close)
 	}
 
+	// init janitor
+	for i := range cache.janitors {
+		cache.janitors[i] = newJanitor[K, V](newLogger(conf.Logger), conf.Verbose, cache.close)
+	}
 	// init shard
 	for i := 0; i < conf.Shards; i++ {
-		cache.shards[i] = newCacheShard(conf, i, onRemove, cache.close)
+		cache.shards[i] = newCacheShard(conf, i, onRemoval, removals, cache.events, cache.janitors[i%conf.Janitors])
+	}
+	// restore, the append-only file holds all the writes so the snapshot only seeds a new one
+	aofExists := false
+	if conf.AOFPath != "" {
+		info, err := os.Stat(conf.AOFPath)
+		aofExists = err == nil && info.Size() > 0 // an empty file holds nothing, even the types of a codec
+	}
+	if conf.SnapshotPath != "" && !aofExists {
+		if err := cache.loadSnapshotFile(); err != nil {
+			close(cache.close)
+			return nil, fmt.Errorf("load snapshot %s: %w", conf.SnapshotPath, err)
+		}
+	}
+	if conf.AOFPath != "" {
+		if err := cache.replayAOF(); err != nil {
+			close(cache.close)
+			return nil, fmt.Errorf("replay aof %s: %w", conf.AOFPath, err)
+		}
+		aof, err := openAOF(conf, cache.codec(), cache.shards)
+		if err != nil {
+			close(cache.close)
+			return nil, fmt.Errorf("open aof %s: %w", conf.AOFPath, err)
+		}
+		cache.aof = aof
+		for _, shard := range cache.shards {
+			shard.aof = aof
+		}
+	}
+	if conf.SnapshotPath != "" {
+		go cache.snapshotLoop()
+	}
+	// goroutine clean expired key
+	for _, j := range cache.janitors {
+		go j.run()
 	}
 	return cache, nil
 }
 
 // Set add k/v or modify existing k/v
-func (e *EasyCache) Set(key string, value interface{}, duration time.Duration) error {
+func (c *Cache[K, V]) Set(key K, value V, duration time.Duration) error {
 
-	hashedKey := e.hash.Sum64(key)
-	shard := e.getShard(hashedKey)
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
 	return shard.set(key, value, duration)
 
 }
 
+// SetSliding sets a key which expires duration after the last Get, whatever Config.Sliding is
+func (c *Cache[K, V]) SetSliding(key K, value V, duration time.Duration) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.setSliding(key, value, duration, true)
+}
+
 // Get get k/v if exist,otherwise get an error
-func (e *EasyCache) Get(key string) (interface{}, error) {
-	hashedKey := e.hash.Sum64(key)
-	shard := e.getShard(hashedKey)
+func (c *Cache[K, V]) Get(key K) (V, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
 	return shard.get(key)
 }
 
-// GetIfNotExist get an existing k/v  or  create a new k/v though by Getter
-func (e *EasyCache) GetIfNotExist(key string, g Getter, duration time.Duration) (interface{}, error) {
-	hashedKey := e.hash.Sum64(key)
-	shard := e.getShard(hashedKey)
-	return shard.getIfNotExist(key, g, duration)
+// GetIfNotExist get an existing k/v  or  create a new k/v though by Loader
+func (c *Cache[K, V]) GetIfNotExist(key K, g Loader[K, V], duration time.Duration) (V, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.getIfNotExist(context.Background(), key, loaderWithTTL[K, V]{loaderWithoutContext[K, V]{g}, duration})
+}
+
+// GetIfNotExistCtx is GetIfNotExist with a LoaderWithContext.
+// The caller stops waiting once ctx is done, but the load goes on and fills the cache for the other callers.
+// The load itself is bounded by CacheConfig.LoadTimeout.
+func (c *Cache[K, V]) GetIfNotExistCtx(ctx context.Context, key K, loader LoaderWithContext[K, V], duration time.Duration) (V, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.getIfNotExist(ctx, key, loaderWithTTL[K, V]{loader, duration})
 }
 
-func (e *EasyCache) GetOrSet(key string, value interface{}, duration time.Duration) (interface{}, error) {
-	hashedKey := e.hash.Sum64(key)
-	shard := e.getShard(hashedKey)
+// GetIfNotExistWithTTL is GetIfNotExistCtx whose lifeSpan of the new k/v is returned by the loader
+func (c *Cache[K, V]) GetIfNotExistWithTTL(ctx context.Context, key K, loader TTLLoader[K, V]) (V, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.getIfNotExist(ctx, key, loader)
+}
+
+func (c *Cache[K, V]) GetOrSet(key K, value V, duration time.Duration) (V, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
 	return shard.getorset(key, value, duration)
 }
 
-func (e *EasyCache) Delete(key string) error {
-	hashedKey := e.hash.Sum64(key)
-	shard := e.getShard(hashedKey)
+func (c *Cache[K, V]) Delete(key K) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
 	return shard.del(key)
 }
 
-func (e *EasyCache) Count() int {
+func (c *Cache[K, V]) Count() int {
 	count := 0
-	for _, shard := range e.shards {
+	for _, shard := range c.shards {
 		count += shard.count()
 	}
 	return count
 }
 
-func (e *EasyCache) Foreach(f func(key string, value interface{})) {
-	for _, shard := range e.shards {
+// Weight returns the total weight of all k/v, see CacheConfig.Weigher
+func (c *Cache[K, V]) Weight() int64 {
+	var weight int64
+	for _, shard := range c.shards {
+		weight += shard.totalWeight()
+	}
+	return weight
+}
+
+// Stats returns the counters of all shards added up
+func (c *Cache[K, V]) Stats() Stats {
+	var stats Stats
+	for _, shard := range c.shards {
+		stats.add(shard.stats.snapshot())
+	}
+	return stats
+}
+
+// ShardStats returns the counters of every shard
+func (c *Cache[K, V]) ShardStats() []Stats {
+	stats := make([]Stats, len(c.shards))
+	for i, shard := range c.shards {
+		stats[i] = shard.stats.snapshot()
+	}
+	return stats
+}
+
+// ResetStats sets all counters to zero
+func (c *Cache[K, V]) ResetStats() {
+	for _, shard := range c.shards {
+		shard.stats.reset()
+	}
+}
+
+func (c *Cache[K, V]) Foreach(f func(key K, value V)) {
+	for _, shard := range c.shards {
 		shard.foreach(f)
 	}
 }
 
-func (e *EasyCache) Exists(key string) bool {
-	hashedKey := e.hash.Sum64(key)
-	shard := e.getShard(hashedKey)
+func (c *Cache[K, V]) Exists(key K) bool {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
 	return shard.exists(key)
 }
 
-func (e *EasyCache) Close() error {
-	close(e.close)
-	return nil
+// MGet returns the values of keys in the same order, errs[i] is ErrKeyNotExist if keys[i] does not exist.
+// Keys are grouped by shard, so each shard is locked once.
+func (c *Cache[K, V]) MGet(keys []K) ([]V, []error) {
+	values := make([]V, len(keys))
+	errs := make([]error, len(keys))
+	now := time.Now() // one clock read for the batch
+	c.groupByShard(keys, func(shard *cacheShard[K, V], idx []int) {
+		shard.mget(keys, idx, now, values, errs)
+	})
+	return values, errs
+}
+
+// MSet sets all the items with the same duration, each shard is locked once.
+// It returns the errors of the keys which failed, nil if all of them are set.
+func (c *Cache[K, V]) MSet(items map[K]V, duration time.Duration) map[K]error {
+	keys := make([]K, 0, len(items))
+	values := make([]V, 0, len(items))
+	for key, value := range items {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	errs := make([]error, len(keys))
+	c.groupByShard(keys, func(shard *cacheShard[K, V], idx []int) {
+		shard.mset(keys, values, idx, duration, errs)
+	})
+
+	var failed map[K]error
+	for i, err := range errs {
+		if err != nil {
+			if failed == nil {
+				failed = make(map[K]error)
+			}
+			failed[keys[i]] = err
+		}
+	}
+	return failed
+}
+
+// MDelete deletes keys, errs[i] is ErrKeyNotExist if keys[i] does not exist. Each shard is locked once.
+func (c *Cache[K, V]) MDelete(keys []K) []error {
+	errs := make([]error, len(keys))
+	c.groupByShard(keys, func(shard *cacheShard[K, V], idx []int) {
+		shard.mdel(keys, idx, errs)
+	})
+	return errs
+}
+
+// groupByShard sorts the indexes of keys by shard, and calls f once per shard with the indexes of its keys
+func (c *Cache[K, V]) groupByShard(keys []K, f func(shard *cacheShard[K, V], idx []int)) {
+	// shard index << 32 | key index
+	buf := make([]uint64, 2*len(keys))
+	order, tmp := buf[:len(keys)], buf[len(keys):]
+	for i, key := range keys {
+		order[i] = (c.hash.Sum64(key)&c.shardMask)<<32 | uint64(i)
+	}
+
+	// radix sort by shard index, 8 bits a pass
+	for shift := 32; shift < 32+bits.Len64(c.shardMask); shift += 8 {
+		var count [257]int
+		for _, o := range order {
+			count[(o>>shift)&0xff+1]++
+		}
+		for i := 1; i < len(count); i++ {
+			count[i] += count[i-1]
+		}
+		for _, o := range order {
+			digit := (o >> shift) & 0xff
+			tmp[count[digit]] = o
+			count[digit]++
+		}
+		order, tmp = tmp, order
+	}
+
+	idx := make([]int, len(order))
+	for i := range order {
+		idx[i] = int(order[i] & math.MaxUint32)
+	}
+	for start := 0; start < len(order); {
+		shard := order[start] >> 32
+		end := start + 1
+		for end < len(order) && order[end]>>32 == shard {
+			end++
+		}
+		f(c.shards[shard], idx[start:end])
+		start = end
+	}
+}
+
+// GetWithVersion returns the value and its version, the version changes on every write of the key
+func (c *Cache[K, V]) GetWithVersion(key K) (V, uint64, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.getWithVersion(key)
+}
+
+// SetIfAbsent sets the key only if it does not exist, it reports whether the key is set
+func (c *Cache[K, V]) SetIfAbsent(key K, value V, duration time.Duration) (bool, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.setIf(key, value, duration, false, func(item *cacheItem[K, V]) bool {
+		return item == nil
+	})
+}
+
+// SetIfPresent sets the key only if it exists, it reports whether the key is set
+func (c *Cache[K, V]) SetIfPresent(key K, value V, duration time.Duration) (bool, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.setIf(key, value, duration, false, func(item *cacheItem[K, V]) bool {
+		return item != nil
+	})
+}
+
+// CompareAndSwap replaces the value of the key with new if it is equal to old, the TTL is kept.
+// Values which are not comparable are never equal, use CompareVersionAndSwap for them.
+func (c *Cache[K, V]) CompareAndSwap(key K, old, new V) (bool, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.setIf(key, new, 0, true, func(item *cacheItem[K, V]) bool {
+		return item != nil && equal(item.Value(), old)
+	})
+}
+
+// CompareAndDelete deletes the key if its value is equal to old
+func (c *Cache[K, V]) CompareAndDelete(key K, old V) bool {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.delIf(key, func(item *cacheItem[K, V]) bool {
+		return equal(item.Value(), old)
+	})
+}
+
+// CompareVersionAndSwap replaces the value of the key with new if it is still at version (see GetWithVersion), the TTL is kept
+func (c *Cache[K, V]) CompareVersionAndSwap(key K, version uint64, new V) (bool, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.setIf(key, new, 0, true, func(item *cacheItem[K, V]) bool {
+		return item != nil && item.version == version
+	})
+}
+
+// CompareVersionAndDelete deletes the key if it is still at version
+func (c *Cache[K, V]) CompareVersionAndDelete(key K, version uint64) bool {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.delIf(key, func(item *cacheItem[K, V]) bool {
+		return item.version == version
+	})
+}
+
+/*
+Compute runs f with the old value of the key under the shard lock, and keeps, replaces or deletes the key as f returns.
+It returns the value of the key afterwards and whether it exists.
+f must not call the cache, or it deadlocks.
+*/
+func (c *Cache[K, V]) Compute(key K, f ComputeFunc[V]) (V, bool, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.compute(key, f)
+}
+
+// ComputeIfAbsent sets the key to the value returned by f if it does not exist, and returns the value of the key
+func (c *Cache[K, V]) ComputeIfAbsent(key K, f func() (V, time.Duration)) (V, error) {
+	value, _, err := c.Compute(key, func(old V, exists bool) (V, time.Duration, Action) {
+		if exists {
+			return old, 0, Keep
+		}
+		value, ttl := f()
+		return value, ttl, Replace
+	})
+	return value, err
+}
+
+// ComputeIfPresent runs f only if the key exists, see Compute
+func (c *Cache[K, V]) ComputeIfPresent(key K, f func(old V) (V, time.Duration, Action)) (V, bool, error) {
+	return c.Compute(key, func(old V, exists bool) (V, time.Duration, Action) {
+		if !exists {
+			return old, 0, Keep
+		}
+		return f(old)
+	})
+}
+
+// IncrBy adds delta to the integer value of the key atomically and keeps its TTL.
+// A missing key is created with ttlIfCreated, ErrNotNumeric is returned if the value is not an integer.
+func (c *Cache[K, V]) IncrBy(key K, delta int64, ttlIfCreated time.Duration) (int64, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+
+	var n int64
+	err := shard.incr(key, ttlIfCreated, func(old interface{}) (interface{}, error) {
+		value, sum, err := incrInt(old, delta)
+		n = sum
+		return value, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Incr adds 1 to the integer value of the key, see IncrBy
+func (c *Cache[K, V]) Incr(key K, ttlIfCreated time.Duration) (int64, error) {
+	return c.IncrBy(key, 1, ttlIfCreated)
+}
+
+// DecrBy subtracts delta from the integer value of the key, see IncrBy
+func (c *Cache[K, V]) DecrBy(key K, delta int64, ttlIfCreated time.Duration) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return c.IncrBy(key, -delta, ttlIfCreated)
+}
+
+// Decr subtracts 1 from the integer value of the key, see IncrBy
+func (c *Cache[K, V]) Decr(key K, ttlIfCreated time.Duration) (int64, error) {
+	return c.IncrBy(key, -1, ttlIfCreated)
+}
+
+// IncrByFloat adds delta to the numeric value of the key atomically and keeps its TTL.
+// Integers become float64, a missing key is created with ttlIfCreated
+func (c *Cache[K, V]) IncrByFloat(key K, delta float64, ttlIfCreated time.Duration) (float64, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+
+	var n float64
+	err := shard.incr(key, ttlIfCreated, func(old interface{}) (interface{}, error) {
+		value, sum, err := incrFloat(old, delta)
+		n = sum
+		return value, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// DecrByFloat subtracts delta from the numeric value of the key, see IncrByFloat
+func (c *Cache[K, V]) DecrByFloat(key K, delta float64, ttlIfCreated time.Duration) (float64, error) {
+	return c.IncrByFloat(key, -delta, ttlIfCreated)
+}
+
+// TTL returns the remaining time to live of the key, 0 if it never expires
+func (c *Cache[K, V]) TTL(key K) (time.Duration, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.ttl(key)
+}
+
+// Expire sets the key to expire after duration, a non-positive duration expires it at once
+func (c *Cache[K, V]) Expire(key K, duration time.Duration) error {
+	return c.ExpireAt(key, time.Now().Add(duration))
+}
+
+// ExpireAt sets the key to expire at t, a time in the past expires it at once and the zero time persists it
+func (c *Cache[K, V]) ExpireAt(key K, t time.Time) error {
+	if t.IsZero() {
+		return c.Persist(key)
+	}
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.expireAt(key, t)
+}
+
+// Persist removes the expiration of the key
+func (c *Cache[K, V]) Persist(key K) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.expireAt(key, time.Time{})
+}
+
+// Touch restarts the lifeSpan of the key from now on
+func (c *Cache[K, V]) Touch(key K) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	return shard.touch(key)
+}
+
+// Subscribe returns a channel receiving the changes selected by filter, cancel stops the subscription and closes the channel
+func (c *Cache[K, V]) Subscribe(filter EventFilter) (events <-chan Event[K, V], cancel func()) {
+	return c.events.subscribe(filter)
+}
+
+// Close stops the background goroutines, the last snapshot is saved first if Config.SnapshotPath is set,
+// and the append-only file is flushed
+func (c *Cache[K, V]) Close() error {
+	var err error
+	if c.conf.SnapshotPath != "" {
+		err = c.saveSnapshotFile(true)
+	}
+	if c.aof != nil { // before the janitors flush the shards, a rewrite in progress copies them
+		if aofErr := c.aof.closeFile(); err == nil {
+			err = aofErr
+		}
+	}
+	close(c.close)
+	c.events.close()
+	return err
 }
-func (e *EasyCache) getShard(hashedKey uint64) (shard *cacheShard) {
-	return e.shards[hashedKey&e.shardMask]
+func (c *Cache[K, V]) getShard(hashedKey uint64) (shard *cacheShard[K, V]) {
+	return c.shards[hashedKey&c.shardMask]
 }
 
-func (e *EasyCache) notProvidedOnRemove(key string, value interface{}, reason RemoveReason) {
+func (c *Cache[K, V]) notProvidedOnRemoval(event RemovalEvent[K, V]) {
 }
@@ -185,3 +185,125 @@ func getOrSetCache(b *testing.B, shards int, cap uint32) {
 		}
 	})
 }
+
+func BenchmarkExpireCleanup(b *testing.B) {
+	for _, ttlKeys := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("heap-%d-ttl-keys", ttlKeys), func(b *testing.B) {
+			expireCleanup(b, ttlKeys, false)
+		})
+		b.Run(fmt.Sprintf("scan-%d-ttl-keys", ttlKeys), func(b *testing.B) {
+			expireCleanup(b, ttlKeys, true)
+		})
+	}
+}
+
+// expireCleanup measures one cleanup pass which removes a single expired key from a shard holding ttlKeys alive keys.
+// scan walks every key with a lifeSpan, as expireCleanup did before expireItems became a heap.
+func expireCleanup(b *testing.B, ttlKeys int, scan bool) {
+	cache, _ := New(Config{
+		Shards:  1,
+		Cap:     uint32(ttlKeys + 1),
+		Hasher:  newDefaultHasher(),
+		Logger:  DefaultLogger(),
+		Verbose: false,
+	})
+	defer cache.Close()
+
+	for i := 0; i < ttlKeys; i++ {
+		cache.Set(strconv.Itoa(i), message, defaultInternal+time.Duration(i+1)*time.Second)
+	}
+	shard := cache.shards[0]
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cache.Set("expired", message, defaultInternal)
+		now := time.Now().Add(defaultInternal)
+		shard.lock.Lock()
+		b.StartTimer()
+
+		if scan {
+			smallestInternal := 0 * time.Second
+			var expired []*cacheItem[string, interface{}]
+			for _, item := range shard.expireItems {
+				if item.expired(now) {
+					expired = append(expired, item)
+				} else if d := item.expireAt.Sub(now); smallestInternal == 0 || d < smallestInternal {
+					smallestInternal = d
+				}
+			}
+			for _, item := range expired {
+				shard.expire(item)
+			}
+		} else {
+			shard.cleanup(now)
+		}
+
+		b.StopTimer()
+		shard.lock.Unlock()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkMGet(b *testing.B) {
+	for _, shards := range []int{16, 1024} {
+		conf := DefaultConfig()
+		conf.Shards = shards
+		cache, _ := New(conf)
+		keys := make([]string, 100)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key-%d", i)
+			cache.Set(keys[i], message, 0)
+		}
+
+		b.Run(fmt.Sprintf("%d-shards-loop-get", shards), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					for _, key := range keys {
+						cache.Get(key)
+					}
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("%d-shards-mget", shards), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					cache.MGet(keys)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMSet(b *testing.B) {
+	for _, shards := range []int{16, 1024} {
+		conf := DefaultConfig()
+		conf.Shards = shards
+		cache, _ := New(conf)
+		items := make(map[string]interface{}, 100)
+		for i := 0; i < 100; i++ {
+			items[fmt.Sprintf("key-%d", i)] = message
+		}
+
+		b.Run(fmt.Sprintf("%d-shards-loop-set", shards), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					for key, value := range items {
+						cache.Set(key, value, time.Minute)
+					}
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("%d-shards-mset", shards), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					cache.MSet(items, time.Minute)
+				}
+			})
+		})
+	}
+}
@@ -1,8 +1,15 @@
 package easycache
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -164,3 +171,1217 @@ func TestGetIfNotExist(t *testing.T) {
 
 	assertEqual(t, "yay!this is soruce", cacheValue)
 }
+
+func TestTypedCache(t *testing.T) {
+	t.Parallel()
+
+	type user struct {
+		Name string
+	}
+
+	conf := DefaultCacheConfig[int, *user]()
+	conf.Hasher = KeyHasherFunc[int](func(k int) uint64 { return uint64(k) })
+	cache, err := NewCache(conf)
+	noError(t, err)
+
+	cache.Set(1, &user{Name: "easy"}, 0*time.Second)
+	u, err := cache.Get(1)
+	noError(t, err)
+	assertEqual(t, "easy", u.Name)
+
+	u, err = cache.Get(2)
+	assertEqual(t, ErrKeyNotExist, err)
+	assertEqual(t, (*user)(nil), u)
+
+	u, _ = cache.GetIfNotExist(3, LoaderFunc[int, *user](func(k int) (*user, error) {
+		return &user{Name: strconv.Itoa(k)}, nil
+	}), 0*time.Second)
+	assertEqual(t, "3", u.Name)
+}
+
+func TestTypedCacheRequiresHasher(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewCache(DefaultCacheConfig[int, int]())
+	if err == nil {
+		t.Error("expected error for missing hasher")
+	}
+
+	// string keys fall back to fnv64
+	conf := DefaultCacheConfig[string, int]()
+	conf.Hasher = nil
+	_, err = NewCache(conf)
+	noError(t, err)
+}
+
+func TestLazyExpire(t *testing.T) {
+	t.Parallel()
+
+	removed := make(map[string]RemoveReason)
+	conf := TestConfig()
+	conf.Shards = 1
+	conf.Cap = 8
+	conf.OnRemoveWithReason = func(key string, value interface{}, reason RemoveReason) {
+		removed[key] = reason
+	}
+	cache, _ := New(conf)
+
+	keys := []string{"get", "exists", "getorset", "getifnotexist"}
+	for _, key := range keys {
+		cache.Set(key, 0, time.Hour)
+	}
+
+	// expired long ago, but expireCleanup is not due for an hour
+	shard := cache.shards[0]
+	shard.lock.Lock()
+	for _, key := range keys {
+		item := shard.items[key]
+		item.createdOn = item.createdOn.Add(-2 * time.Hour)
+		item.expireAt = item.expireAt.Add(-2 * time.Hour)
+	}
+	shard.lock.Unlock()
+
+	_, err := cache.Get("get")
+	assertEqual(t, ErrKeyNotExist, err)
+	assertEqual(t, false, cache.Exists("exists"))
+
+	val, _ := cache.GetOrSet("getorset", 1, 0)
+	assertEqual(t, 1, val)
+
+	val, _ = cache.GetIfNotExist("getifnotexist", GetterFunc(func(s string) (interface{}, error) {
+		return 2, nil
+	}), 0)
+	assertEqual(t, 2, val)
+
+	for _, key := range keys {
+		assertEqual(t, Expired, removed[key])
+	}
+	assertEqual(t, 2, cache.Count())
+}
+
+func TestExpireCleanupOrder(t *testing.T) {
+	t.Parallel()
+
+	conf := TestConfig()
+	conf.Shards = 1
+	conf.Cap = 8
+	conf.Verbose = false
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	for i, ttl := range []int{5, 1, 4, 2, 3} {
+		cache.Set(strconv.Itoa(i), i, defaultInternal+time.Duration(ttl)*time.Minute)
+	}
+	cache.Set("persist", 0, 0)
+
+	shard := cache.shards[0]
+	shard.lock.Lock()
+	next := shard.cleanup(time.Now().Add(defaultInternal + 150*time.Second))
+	shard.lock.Unlock()
+
+	// ttl 1,2 minutes are removed, ttl 3 minutes is the next one
+	if next <= 0 || next > 30*time.Second {
+		t.Errorf("unexpected next interval %v", next)
+	}
+	assertEqual(t, 4, cache.Count())
+	assertEqual(t, false, cache.Exists("1"))
+	assertEqual(t, false, cache.Exists("3"))
+	assertEqual(t, true, cache.Exists("4"))
+	assertEqual(t, 3, shard.expireItems.Len())
+}
+
+func TestJanitor(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cache, _ := New(DefaultConfig()) // 1024 shards share one janitor
+	assertEqual(t, before+1, runtime.NumGoroutine())
+
+	expired := make(chan string, 1)
+	conf := TestConfig()
+	conf.Verbose = false
+	conf.OnRemoveWithReason = func(key string, value interface{}, reason RemoveReason) {
+		expired <- key
+	}
+	cache1, _ := New(conf)
+	cache1.Set("long", 0, time.Hour)
+	cache1.Set("short", 0, 50*time.Millisecond) // wakes up the janitor earlier
+
+	select {
+	case key := <-expired:
+		assertEqual(t, "short", key)
+	case <-time.After(time.Second):
+		t.Error("expired key is not cleaned up")
+	}
+
+	cache.Close()
+	cache1.Close()
+	time.Sleep(10 * time.Millisecond)
+	assertEqual(t, before, runtime.NumGoroutine())
+}
+
+func TestConcurrentGetAndSet(t *testing.T) {
+	t.Parallel()
+
+	// run with -race: get only holds the read lock, the lru list must never be touched there
+	conf := DefaultConfig()
+	conf.Shards = 2
+	conf.Cap = 64
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	for i := 0; i < 128; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				key := strconv.Itoa((i * (g + 1)) % 256)
+				if i%10 == 0 {
+					cache.Set(key, i, time.Duration(i%3)*time.Millisecond)
+				} else {
+					cache.Get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if cache.Count() > 128 {
+		t.Errorf("count %d over cap", cache.Count())
+	}
+	for _, shard := range cache.shards {
+		shard.lock.Lock()
+		shard.drainReads()
+		assertEqual(t, len(shard.items), len(shard.policy.(*lruPolicy[string]).elems))
+		shard.lock.Unlock()
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.Cap = 0
+	conf.MaxBytes = 100
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	for i := 0; i < 5; i++ { // every k/v weighs 1+30 bytes
+		noError(t, cache.Set(strconv.Itoa(i), blob('a', 30), 0))
+	}
+	assertEqual(t, 3, cache.Count())
+	assertEqual(t, int64(93), cache.Weight())
+	assertEqual(t, false, cache.Exists("0"))
+	assertEqual(t, false, cache.Exists("1"))
+
+	// heavier value of an existing key evicts others
+	noError(t, cache.Set("4", blob('a', 60), 0))
+	assertEqual(t, 2, cache.Count())
+	assertEqual(t, int64(92), cache.Weight())
+
+	assertEqual(t, ErrEntryTooLarge, cache.Set("big", blob('a', 100), 0))
+	assertEqual(t, false, cache.Exists("big"))
+
+	cache.Delete("4")
+	assertEqual(t, int64(31), cache.Weight())
+}
+
+func TestMaxBytesUpdate(t *testing.T) {
+	t.Parallel()
+
+	for _, kind := range []EvictionKind{EvictLRU, EvictLFU, EvictFIFO, EvictRandom, EvictWTinyLFU} {
+		conf := DefaultConfig()
+		conf.Shards = 1
+		conf.Cap = 0
+		conf.MaxBytes = 100
+		conf.Eviction = kind
+		cache, _ := New(conf)
+
+		for i := 0; i < 3; i++ {
+			noError(t, cache.Set(strconv.Itoa(i), blob('a', 20), 0))
+		}
+		for i := 0; i < 3; i++ { // older keys are hotter
+			cache.Get("0")
+			cache.Get("1")
+		}
+		// the key being written is the victim of every policy, the others are evicted
+		for _, size := range []int{90, 40, 95} {
+			noError(t, cache.Set("2", blob('a', size), 0))
+			if cache.Weight() > conf.MaxBytes {
+				t.Errorf("policy %d: weight %d over max bytes %d", kind, cache.Weight(), conf.MaxBytes)
+			}
+		}
+		assertEqual(t, true, cache.Exists("2"))
+		cache.Close()
+	}
+}
+
+func TestWeigher(t *testing.T) {
+	t.Parallel()
+
+	type image struct {
+		pixels []byte
+	}
+
+	conf := DefaultCacheConfig[string, *image]()
+	conf.Shards = 2
+	conf.MaxBytes = 2 * 25 << 20 // 25MB a shard
+	conf.Weigher = func(key string, value *image) int64 {
+		return int64(len(value.pixels))
+	}
+	cache, _ := NewCache(conf)
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), &image{pixels: make([]byte, 10<<20)}, 0)
+	}
+	if cache.Weight() > conf.MaxBytes {
+		t.Errorf("weight %d over max bytes %d", cache.Weight(), conf.MaxBytes)
+	}
+	assertEqual(t, cache.Weight(), int64(cache.Count())*10<<20)
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.Shards = 2
+	conf.Cap = 1
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	cache.Set("a", 1, 0)
+	cache.Get("a")
+	cache.Get("missing")
+	cache.GetOrSet("a", 2, 0)
+	cache.GetIfNotExist("load", GetterFunc(func(key string) (interface{}, error) {
+		time.Sleep(time.Millisecond)
+		return key, nil
+	}), 0)
+	cache.GetIfNotExist("fail", GetterFunc(func(key string) (interface{}, error) {
+		return nil, ErrKeyNotExist
+	}), 0)
+	cache.Delete("a")
+
+	stats := cache.Stats()
+	assertEqual(t, int64(2), stats.Hits)
+	assertEqual(t, int64(3), stats.Misses)
+	assertEqual(t, int64(2), stats.Sets)
+	assertEqual(t, int64(1), stats.Removed(Deleted))
+	assertEqual(t, int64(1), stats.LoadSuccess)
+	assertEqual(t, int64(1), stats.LoadFailure)
+	if stats.LoadTime < time.Millisecond {
+		t.Errorf("load time %v", stats.LoadTime)
+	}
+
+	// every shard keeps 1 key, "load" and 10 new keys leave 9 evicted
+	for i := 0; i < 10; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+	}
+	var total Stats
+	for _, s := range cache.ShardStats() {
+		total.add(s)
+	}
+	assertEqual(t, cache.Stats(), total)
+	assertEqual(t, 2, cache.Count())
+	assertEqual(t, int64(9), total.NoSpace)
+
+	cache.ResetStats()
+	assertEqual(t, Stats{}, cache.Stats())
+}
+
+func TestGetIfNotExistLoadsOutsideLock(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.Shards = 1
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	release := make(chan struct{})
+	var calls int32
+	loader := GetterFunc(func(key string) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release // slow database
+		return "loaded", nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := cache.GetIfNotExist("slow", loader, 0)
+			noError(t, err)
+			assertEqual(t, "loaded", val)
+		}()
+	}
+
+	// other keys of the shard are not blocked
+	done := make(chan struct{})
+	go func() {
+		cache.Set("fast", 1, 0)
+		cache.Get("fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("shard is blocked by the loader")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assertEqual(t, int32(1), atomic.LoadInt32(&calls))
+	assertEqual(t, int64(1), cache.Stats().LoadSuccess)
+}
+
+func TestGetIfNotExistPanic(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	release := make(chan struct{})
+	loader := GetterFunc(func(key string) (interface{}, error) {
+		<-release
+		panic("boom")
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.GetIfNotExist("panic", loader, 0)
+			assertEqual(t, true, errors.Is(err, ErrLoaderPanic))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assertEqual(t, false, cache.Exists("panic"))
+	assertEqual(t, int64(1), cache.Stats().LoadFailure)
+}
+
+func TestGetIfNotExistAfterClose(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.StaleTTL = time.Minute
+	cache, _ := New(conf)
+	loader := GetterFunc(func(key string) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return key, nil
+	})
+	cache.GetIfNotExist("stale", loader, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	cache.GetIfNotExist("stale", loader, time.Millisecond) // background refresh
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		val, err := cache.GetIfNotExist("slow", loader, 0)
+		noError(t, err)
+		assertEqual(t, "slow", val)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cache.Close() // the loads finish after the shards are flushed
+	<-done
+	time.Sleep(60 * time.Millisecond)
+}
+
+func TestGetIfNotExistCtx(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	release := make(chan struct{})
+	loader := LoaderWithContextFunc[string, interface{}](func(ctx context.Context, key string) (interface{}, error) {
+		select {
+		case <-release:
+			return "loaded", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+
+	// the first caller gives up, the load goes on
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := cache.GetIfNotExistCtx(ctx, "key", loader, 0)
+	assertEqual(t, context.DeadlineExceeded, err)
+
+	done := make(chan interface{})
+	go func() {
+		val, _ := cache.GetIfNotExistCtx(context.Background(), "key", loader, 0)
+		done <- val
+	}()
+	close(release)
+	assertEqual(t, "loaded", <-done)
+
+	val, err := cache.Get("key")
+	noError(t, err)
+	assertEqual(t, "loaded", val)
+	assertEqual(t, int64(1), cache.Stats().LoadSuccess)
+}
+
+func TestLoadTimeout(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.LoadTimeout = 20 * time.Millisecond
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	// hung backend
+	_, err := cache.GetIfNotExistCtx(context.Background(), "key", LoaderWithContextFunc[string, interface{}](func(ctx context.Context, key string) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}), 0)
+	assertEqual(t, context.DeadlineExceeded, err)
+
+	// a Getter can not be cancelled, but the caller does not wait forever
+	_, err = cache.GetIfNotExist("key1", GetterFunc(func(key string) (interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	}), 0)
+	assertEqual(t, context.DeadlineExceeded, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assertEqual(t, int64(1), cache.Stats().LoadFailure)
+	assertEqual(t, true, cache.Exists("key1"))
+}
+
+func TestGetIfNotExistWithTTL(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	// freshness is only known after fetching
+	loader := TTLLoaderFunc[string, interface{}](func(ctx context.Context, key string) (interface{}, time.Duration, error) {
+		switch key {
+		case "short":
+			return key, 50 * time.Millisecond, nil
+		case "nostore": // max-age=0
+			return key, 0, nil
+		}
+		return key, NoExpiration, nil
+	})
+
+	val, err := cache.GetIfNotExistWithTTL(context.Background(), "short", loader)
+	noError(t, err)
+	assertEqual(t, "short", val)
+	cache.GetIfNotExistWithTTL(context.Background(), "persist", loader)
+	val, err = cache.GetIfNotExistWithTTL(context.Background(), "nostore", loader)
+	noError(t, err)
+	assertEqual(t, "nostore", val)
+	assertEqual(t, false, cache.Exists("nostore"))
+
+	shard := cache.getShard(cache.hash.Sum64("short"))
+	shard.lock.RLock()
+	assertEqual(t, 50*time.Millisecond, shard.items["short"].LifeSpan())
+	shard.lock.RUnlock()
+
+	time.Sleep(100 * time.Millisecond)
+	assertEqual(t, false, cache.Exists("short"))
+	assertEqual(t, true, cache.Exists("persist"))
+}
+
+func TestNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.NegativeTTL = 50 * time.Millisecond
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	var calls atomic.Int32
+	errBackend := errors.New("backend down")
+	loader := GetterFunc(func(key string) (interface{}, error) {
+		calls.Add(1)
+		if key == "down" {
+			return nil, errBackend
+		}
+		return nil, fmt.Errorf("user %s: %w", key, ErrNotFound)
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.GetIfNotExist("missing", loader, time.Minute)
+		assertEqual(t, true, errors.Is(err, ErrNotFound))
+	}
+	assertEqual(t, int32(1), calls.Load())
+
+	// other errors are not cached by default
+	cache.GetIfNotExist("down", loader, time.Minute)
+	cache.GetIfNotExist("down", loader, time.Minute)
+	assertEqual(t, int32(3), calls.Load())
+
+	// negative k/v are invisible to the other APIs
+	_, err := cache.Get("missing")
+	assertEqual(t, ErrKeyNotExist, err)
+	assertEqual(t, false, cache.Exists("missing"))
+	assertEqual(t, 0, cache.Count())
+
+	// expires after NegativeTTL
+	time.Sleep(100 * time.Millisecond)
+	cache.GetIfNotExist("missing", loader, time.Minute)
+	assertEqual(t, int32(4), calls.Load())
+
+	// set replaces the negative k/v
+	noError(t, cache.Set("missing", "found", 0))
+	val, err := cache.GetIfNotExist("missing", loader, time.Minute)
+	noError(t, err)
+	assertEqual(t, "found", val)
+	assertEqual(t, 1, cache.Count())
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.StaleTTL = time.Second
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := GetterFunc(func(key string) (interface{}, error) {
+		if calls.Add(1) > 1 {
+			<-release // slow backend
+		}
+		return int(calls.Load()), nil
+	})
+
+	val, _ := cache.GetIfNotExist("key", loader, 50*time.Millisecond)
+	assertEqual(t, 1, val)
+	time.Sleep(100 * time.Millisecond) // past the soft TTL
+
+	// stale value at once, and a single reload
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := cache.GetIfNotExist("key", loader, 50*time.Millisecond)
+			noError(t, err)
+			assertEqual(t, 1, val)
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	for i := 0; i < 100 && mustGet(t, cache, "key") == 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assertEqual(t, 2, mustGet(t, cache, "key"))
+	assertEqual(t, int32(2), calls.Load())
+}
+
+func TestRefreshAhead(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.RefreshAhead = 80 * time.Millisecond
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	var calls atomic.Int32
+	loader := GetterFunc(func(key string) (interface{}, error) {
+		return int(calls.Add(1)), nil
+	})
+
+	cache.GetIfNotExist("key", loader, 100*time.Millisecond)
+	assertEqual(t, 1, mustGet(t, cache, "key")) // fresh
+	time.Sleep(50 * time.Millisecond)
+	assertEqual(t, 1, mustGet(t, cache, "key")) // near expiry, reload
+
+	for i := 0; i < 100 && calls.Load() < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assertEqual(t, 2, mustGet(t, cache, "key"))
+	time.Sleep(60 * time.Millisecond) // the first TTL is over, but the key was reloaded
+	assertEqual(t, true, cache.Exists("key"))
+}
+
+func mustGet(t *testing.T, cache *EasyCache, key string) interface{} {
+	val, err := cache.Get(key)
+	noError(t, err)
+	return val
+}
+
+func TestTTL(t *testing.T) {
+	t.Parallel()
+
+	var expired []string
+	conf := DefaultConfig()
+	conf.OnRemoveWithReason = func(key string, value interface{}, reason RemoveReason) {
+		if reason == Expired {
+			expired = append(expired, key)
+		}
+	}
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	cache.Set("key", "value", time.Minute)
+	ttl, err := cache.TTL("key")
+	noError(t, err)
+	assertEqual(t, true, ttl > 59*time.Second && ttl <= time.Minute)
+
+	_, err = cache.TTL("missing")
+	assertEqual(t, ErrKeyNotExist, err)
+	assertEqual(t, ErrKeyNotExist, cache.Expire("missing", time.Second))
+	assertEqual(t, ErrKeyNotExist, cache.Touch("missing"))
+
+	// persist
+	noError(t, cache.Persist("key"))
+	ttl, _ = cache.TTL("key")
+	assertEqual(t, time.Duration(0), ttl)
+
+	// shorten, the janitor is rescheduled
+	noError(t, cache.Expire("key", 50*time.Millisecond))
+	ttl, _ = cache.TTL("key")
+	assertEqual(t, true, ttl > 0 && ttl <= 50*time.Millisecond)
+
+	// touch restarts it
+	time.Sleep(30 * time.Millisecond)
+	noError(t, cache.Touch("key"))
+	time.Sleep(30 * time.Millisecond)
+	assertEqual(t, true, cache.Exists("key"))
+
+	// the janitor removes it without any read
+	time.Sleep(100 * time.Millisecond)
+	shard := cache.getShard(cache.hash.Sum64("key"))
+	shard.lock.RLock()
+	assertEqual(t, 0, len(shard.items))
+	assertEqual(t, 0, shard.expireItems.Len())
+	shard.lock.RUnlock()
+
+	// a deadline in the past expires it at once
+	cache.Set("other", "value", 0)
+	noError(t, cache.ExpireAt("other", time.Now().Add(-time.Second)))
+	assertEqual(t, false, cache.Exists("other"))
+	assertEqual(t, []string{"key", "other"}, expired)
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	cache.SetSliding("session", "value", 60*time.Millisecond)
+	cache.Set("fixed", "value", 60*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		mustGet(t, cache, "session")
+	}
+	assertEqual(t, false, cache.Exists("fixed"))
+	assertEqual(t, true, cache.Exists("session"))
+	ttl, _ := cache.TTL("session")
+	assertEqual(t, true, ttl > 0 && ttl <= 60*time.Millisecond)
+
+	// the janitor reschedules it instead of removing it, and removes it once idle
+	shard := cache.getShard(cache.hash.Sum64("session"))
+	shard.lock.RLock()
+	assertEqual(t, 1, shard.expireItems.Len())
+	shard.lock.RUnlock()
+
+	time.Sleep(150 * time.Millisecond)
+	shard.lock.RLock()
+	assertEqual(t, 0, len(shard.items))
+	shard.lock.RUnlock()
+}
+
+func TestSlidingExists(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.Sliding = true
+	conf.SlidingExists = true
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	cache.Set("session", "value", 60*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		assertEqual(t, true, cache.Exists("session"))
+	}
+
+	// an explicit deadline is fixed
+	cache.Expire("session", 60*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		time.Sleep(40 * time.Millisecond)
+		cache.Get("session")
+	}
+	assertEqual(t, false, cache.Exists("session"))
+}
+
+func TestIncr(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	// created with ttlIfCreated
+	n, err := cache.IncrBy("counter", 5, time.Minute)
+	noError(t, err)
+	assertEqual(t, int64(5), n)
+	ttl, _ := cache.TTL("counter")
+	assertEqual(t, true, ttl > 59*time.Second)
+
+	// the TTL is kept
+	cache.Expire("counter", time.Hour)
+	n, _ = cache.Decr("counter", time.Minute)
+	assertEqual(t, int64(4), n)
+	ttl, _ = cache.TTL("counter")
+	assertEqual(t, true, ttl > 59*time.Minute)
+
+	// the type is kept
+	cache.Set("int8", int8(126), 0)
+	n, _ = cache.Incr("int8", 0)
+	assertEqual(t, int64(127), n)
+	assertEqual(t, int8(127), mustGet(t, cache, "int8"))
+	_, err = cache.Incr("int8", 0)
+	assertEqual(t, ErrOverflow, err)
+	_, err = cache.DecrBy("int8", math.MinInt64, 0)
+	assertEqual(t, ErrOverflow, err)
+
+	cache.Set("string", "1", 0)
+	_, err = cache.Incr("string", 0)
+	assertEqual(t, ErrNotNumeric, err)
+	assertEqual(t, "1", mustGet(t, cache, "string"))
+
+	f, err := cache.IncrByFloat("counter", 0.5, 0)
+	noError(t, err)
+	assertEqual(t, 4.5, f)
+	f, _ = cache.DecrByFloat("float", 1.5, 0)
+	assertEqual(t, -1.5, f)
+	_, err = cache.Incr("float", 0)
+	assertEqual(t, ErrNotNumeric, err)
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cache.Incr("counter", time.Minute)
+			}
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, int64(10000), mustGet(t, cache, "counter"))
+
+	// typed cache
+	typed, _ := NewCache[string, int](DefaultCacheConfig[string, int]())
+	defer typed.Close()
+	n, _ := typed.IncrBy("counter", 2, 0)
+	assertEqual(t, int64(2), n)
+	_, err := typed.IncrByFloat("counter", 1, 0)
+	assertEqual(t, ErrNotNumeric, err)
+}
+
+func TestConditionalSet(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	ok, err := cache.SetIfPresent("key", "v1", 0)
+	noError(t, err)
+	assertEqual(t, false, ok)
+	ok, _ = cache.SetIfAbsent("key", "v1", 0)
+	assertEqual(t, true, ok)
+	ok, _ = cache.SetIfAbsent("key", "v2", 0)
+	assertEqual(t, false, ok)
+	ok, _ = cache.SetIfPresent("key", "v2", time.Minute)
+	assertEqual(t, true, ok)
+	assertEqual(t, "v2", mustGet(t, cache, "key"))
+
+	// compare values, the TTL is kept
+	ok, _ = cache.CompareAndSwap("key", "v1", "v3")
+	assertEqual(t, false, ok)
+	ok, _ = cache.CompareAndSwap("key", "v2", "v3")
+	assertEqual(t, true, ok)
+	ttl, _ := cache.TTL("key")
+	assertEqual(t, true, ttl > 0)
+	assertEqual(t, false, cache.CompareAndDelete("key", "v2"))
+	assertEqual(t, true, cache.CompareAndDelete("key", "v3"))
+	assertEqual(t, false, cache.Exists("key"))
+
+	// values which are not comparable
+	cache.Set("slice", []int{1}, 0)
+	ok, err = cache.CompareAndSwap("slice", []int{1}, []int{2})
+	noError(t, err)
+	assertEqual(t, false, ok)
+}
+
+func TestVersion(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	cache.Set("slice", []int{1}, 0)
+	_, v1, err := cache.GetWithVersion("slice")
+	noError(t, err)
+	cache.Set("slice", []int{2}, 0)
+	_, v2, _ := cache.GetWithVersion("slice")
+	assertEqual(t, true, v2 != v1)
+
+	ok, _ := cache.CompareVersionAndSwap("slice", v1, []int{3})
+	assertEqual(t, false, ok)
+	ok, _ = cache.CompareVersionAndSwap("slice", v2, []int{3})
+	assertEqual(t, true, ok)
+	assertEqual(t, false, cache.CompareVersionAndDelete("slice", v2))
+
+	// a deleted and created again key never gets an old version
+	_, v3, _ := cache.GetWithVersion("slice")
+	cache.Delete("slice")
+	cache.Set("slice", []int{1}, 0)
+	_, v4, _ := cache.GetWithVersion("slice")
+	assertEqual(t, true, v4 != v3 && v4 != v1 && v4 != v2)
+	assertEqual(t, true, cache.CompareVersionAndDelete("slice", v4))
+
+	// optimistic concurrency
+	cache.Set("counter", 0, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; {
+				value, version, _ := cache.GetWithVersion("counter")
+				if ok, _ := cache.CompareVersionAndSwap("counter", version, value.(int)+1); ok {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assertEqual(t, 1000, mustGet(t, cache, "counter"))
+}
+
+func TestCompute(t *testing.T) {
+	t.Parallel()
+
+	var removed []RemoveReason
+	conf := DefaultConfig()
+	conf.OnRemoveWithReason = func(key string, value interface{}, reason RemoveReason) {
+		removed = append(removed, reason)
+	}
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	appendTo := func(old interface{}, exists bool) (interface{}, time.Duration, Action) {
+		if !exists {
+			return []int{1}, time.Minute, Replace
+		}
+		return append(old.([]int), 1), KeepTTL, Replace
+	}
+	cache.Compute("slice", appendTo)
+	cache.Expire("slice", time.Hour)
+	val, ok, err := cache.Compute("slice", appendTo)
+	noError(t, err)
+	assertEqual(t, true, ok)
+	assertEqual(t, []int{1, 1}, val)
+	ttl, _ := cache.TTL("slice")
+	assertEqual(t, true, ttl > 59*time.Minute)
+
+	// keep
+	val, ok, _ = cache.Compute("slice", func(old interface{}, exists bool) (interface{}, time.Duration, Action) {
+		return nil, 0, Keep
+	})
+	assertEqual(t, true, ok)
+	assertEqual(t, []int{1, 1}, val)
+
+	// delete fires the callback
+	_, ok, _ = cache.ComputeIfPresent("slice", func(old interface{}) (interface{}, time.Duration, Action) {
+		return nil, 0, Delete
+	})
+	assertEqual(t, false, ok)
+	assertEqual(t, false, cache.Exists("slice"))
+	assertEqual(t, []RemoveReason{Deleted}, removed)
+
+	_, ok, _ = cache.ComputeIfPresent("slice", func(old interface{}) (interface{}, time.Duration, Action) {
+		t.Fatal("called for a missing key")
+		return nil, 0, Keep
+	})
+	assertEqual(t, false, ok)
+
+	val, _ = cache.ComputeIfAbsent("key", func() (interface{}, time.Duration) { return "v1", 0 })
+	assertEqual(t, "v1", val)
+	val, _ = cache.ComputeIfAbsent("key", func() (interface{}, time.Duration) { return "v2", 0 })
+	assertEqual(t, "v1", val)
+}
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	items := make(map[string]interface{})
+	keys := make([]string, 0, 200)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		items[key] = i
+		keys = append(keys, key, "missing-"+key)
+	}
+	assertEqual(t, 0, len(cache.MSet(items, time.Minute)))
+	assertEqual(t, 100, cache.Count())
+
+	values, errs := cache.MGet(keys)
+	for i := 0; i < 100; i++ {
+		noError(t, errs[2*i])
+		assertEqual(t, i, values[2*i])
+		assertEqual(t, ErrKeyNotExist, errs[2*i+1])
+		assertEqual(t, nil, values[2*i+1])
+	}
+	assertEqual(t, int64(100), cache.Stats().Hits)
+	assertEqual(t, int64(100), cache.Stats().Misses)
+
+	errs = cache.MDelete(keys[:10])
+	for i := 0; i < 5; i++ {
+		noError(t, errs[2*i])
+		assertEqual(t, ErrKeyNotExist, errs[2*i+1])
+	}
+	assertEqual(t, 95, cache.Count())
+
+	// per-key errors
+	conf := DefaultConfig()
+	conf.MaxBytes = 1024 * 10
+	cache, _ = New(conf)
+	defer cache.Close()
+	failed := cache.MSet(map[string]interface{}{"small": "v", "large": string(blob('a', 100))}, 0)
+	assertEqual(t, map[string]error{"large": ErrEntryTooLarge}, failed)
+	assertEqual(t, true, cache.Exists("small"))
+}
+
+func TestRemovalEvent(t *testing.T) {
+	t.Parallel()
+
+	var callbacks []string
+	var events []RemovalEvent[string, interface{}]
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.Cap = 2
+	conf.OnRemoveWithReason = func(key string, value interface{}, reason RemoveReason) {
+		callbacks = append(callbacks, key+"="+value.(string))
+	}
+	conf.OnRemoval = func(event RemovalEvent[string, interface{}]) {
+		events = append(events, event)
+	}
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	cache.Set("a", "1", time.Minute)
+	cache.Set("b", "2", 0)
+	cache.Set("c", "3", 0) // evicts a
+
+	// the key and value of the victim
+	assertEqual(t, []string{"a=1"}, callbacks)
+	assertEqual(t, 1, len(events))
+	event := events[0]
+	assertEqual(t, "a", event.Key)
+	assertEqual(t, "1", event.Value)
+	assertEqual(t, NoSpace, event.Reason)
+	assertEqual(t, 0, event.Shard)
+	assertEqual(t, time.Minute, event.LifeSpan)
+	assertEqual(t, false, event.CreatedOn.IsZero())
+
+	cache.Delete("b")
+	assertEqual(t, []string{"a=1", "b=2"}, callbacks)
+	assertEqual(t, Deleted, events[1].Reason)
+}
+
+func TestAsyncRemoval(t *testing.T) {
+	t.Parallel()
+
+	var cache *EasyCache
+	keys := make(chan string, 100)
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.Cap = 128
+	conf.RemovalWorkers = 4
+	conf.OnRemoveWithReason = func(key string, value interface{}, reason RemoveReason) {
+		cache.Exists(key) // calls the cache while the shard is being written
+		keys <- key
+	}
+	cache, _ = New(conf)
+
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+	}
+	for i := 0; i < 100; i++ {
+		noError(t, cache.Delete(strconv.Itoa(i)))
+	}
+	// in order of the shard
+	for i := 0; i < 100; i++ {
+		assertEqual(t, strconv.Itoa(i), <-keys)
+	}
+	cache.Close()
+}
+
+func TestAsyncRemovalReentrant(t *testing.T) {
+	t.Parallel()
+
+	var cache *EasyCache
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.RemovalWorkers = 1
+	conf.RemovalQueueSize = 1
+	conf.OnRemoval = func(event RemovalEvent[string, interface{}]) {
+		time.Sleep(time.Millisecond) // slow callback calls the cache
+		cache.Exists(event.Key)
+	}
+	cache, _ = New(conf)
+	defer cache.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			cache.Set(strconv.Itoa(i), i, 0)
+			cache.Delete(strconv.Itoa(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("deadlock of a full queue and a callback calling the cache")
+	}
+	assertEqual(t, true, cache.Stats().DroppedEvents > 0)
+}
+
+func TestAsyncRemovalOverflow(t *testing.T) {
+	t.Parallel()
+
+	for _, overflow := range []OverflowPolicy{OverflowDrop, OverflowDropOldest} {
+		var delivered atomic.Int64
+		release := make(chan struct{})
+		conf := DefaultConfig()
+		conf.RemovalWorkers = 1
+		conf.RemovalQueueSize = 2
+		conf.RemovalOverflow = overflow
+		conf.OnRemoval = func(event RemovalEvent[string, interface{}]) {
+			<-release // slow callback
+			delivered.Add(1)
+		}
+		cache, _ := New(conf)
+
+		for i := 0; i < 10; i++ {
+			cache.Set(strconv.Itoa(i), i, 0)
+			cache.Delete(strconv.Itoa(i)) // never blocks
+		}
+		dropped := cache.Stats().DroppedEvents
+		assertEqual(t, true, dropped >= 7)
+
+		close(release)
+		for i := 0; i < 100 && delivered.Load()+dropped < 10; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		assertEqual(t, int64(10), delivered.Load()+dropped)
+		cache.Close()
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+
+	all, cancelAll := cache.Subscribe(EventFilter{})
+	users, cancelUsers := cache.Subscribe(EventFilter{KeyPrefix: "user:", Types: Created | Removed})
+	defer cancelUsers()
+
+	cache.Set("user:1", "a", 0)
+	cache.Set("user:1", "b", 0)
+	cache.Set("order:1", "c", 0)
+	cache.Incr("user:count", 0)
+	cache.Delete("user:1")
+
+	type event struct {
+		Type   EventType
+		Key    string
+		Value  interface{}
+		Reason RemoveReason
+	}
+	expected := []event{
+		{Created, "user:1", "a", 0},
+		{Updated, "user:1", "b", 0},
+		{Created, "order:1", "c", 0},
+		{Created, "user:count", int64(1), 0},
+		{Removed, "user:1", "b", Deleted},
+	}
+	for _, e := range expected {
+		got := <-all
+		assertEqual(t, e, event{got.Type, got.Key, got.Value, got.Reason})
+	}
+	for _, i := range []int{0, 3, 4} {
+		got := <-users
+		assertEqual(t, expected[i], event{got.Type, got.Key, got.Value, got.Reason})
+	}
+
+	// cancel closes the channel
+	cancelAll()
+	cancelAll()
+	cache.Set("user:2", "a", 0)
+	_, ok := <-all
+	assertEqual(t, false, ok)
+	assertEqual(t, "user:2", (<-users).Key)
+}
+
+func TestSubscribeSlow(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+
+	dropping, _ := cache.Subscribe(EventFilter{Buffer: 2})
+	blocking, cancel := cache.Subscribe(EventFilter{Buffer: 2, Block: true})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			cache.Set(strconv.Itoa(i), i, 0)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		assertEqual(t, strconv.Itoa(i), (<-blocking).Key)
+	}
+	<-done
+	assertEqual(t, int64(8), cache.Stats().DroppedEvents)
+	assertEqual(t, 2, len(dropping))
+
+	// cancel wakes up a blocked writer
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	cache.Set("a", 0, 0)
+	cache.Set("b", 0, 0)
+	cache.Set("c", 0, 0)
+
+	// close ends all the subscriptions
+	cache.Close()
+	for range dropping {
+	}
+}
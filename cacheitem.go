@@ -1,38 +1,112 @@
 package easycache
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
-type cacheItem struct {
-	key       string
-	value     interface{}
+type cacheItem[K comparable, V any] struct {
+	key       K
+	value     V
 	lifeSpan  time.Duration // 存储时长
 	createdOn time.Time
+	expireAt  time.Time // createdOn + lifeSpan, the scheduled time for sliding items
+	weight    int64
+	err       error  // negative cache: the error of the loader
+	version   uint64 // changes on every write of the value
+
+	// the loader reloads the item in the background after refreshAt (stale-while-revalidate / refresh-ahead)
+	loader    TTLLoader[K, V]
+	refreshAt time.Time
+
+	// sliding items expire lifeSpan after the last access, reads only hold the read lock so it is atomic
+	sliding    bool
+	accessedOn atomic.Int64 // unix nano
+
+	expireIndex int // index in expireHeap, -1 means not in it
 }
 
-func newCacheItem(key string, value interface{}, duration time.Duration) *cacheItem {
+func newCacheItem[K comparable, V any](key K, value V, duration time.Duration) *cacheItem[K, V] {
 
-	item := &cacheItem{
-		key:       key,
-		value:     value,
-		lifeSpan:  duration,
-		createdOn: time.Now(),
+	item := &cacheItem[K, V]{
+		key:         key,
+		expireIndex: -1,
 	}
-
+	item.reset(value, duration)
 	return item
 }
 
-func (i cacheItem) LifeSpan() time.Duration {
+// reset modify value and lifeSpan of the item, the item is created again from now on
+func (i *cacheItem[K, V]) reset(value V, duration time.Duration) {
+	i.value = value
+	i.err = nil
+	i.loader = nil
+	i.lifeSpan = duration
+	i.createdOn = time.Now()
+	i.accessedOn.Store(i.createdOn.UnixNano())
+	i.expireAt = time.Time{}
+	if duration > 0 {
+		i.expireAt = i.createdOn.Add(duration)
+	}
+}
+
+func (i *cacheItem[K, V]) LifeSpan() time.Duration {
 	return i.lifeSpan
 }
 
-func (i cacheItem) CreatedOn() time.Time {
+func (i *cacheItem[K, V]) CreatedOn() time.Time {
 	return i.createdOn
 }
 
-func (i cacheItem) Key() string {
+func (i *cacheItem[K, V]) Key() K {
 	return i.key
 }
 
-func (i cacheItem) Value() interface{} {
+func (i *cacheItem[K, V]) Value() V {
 	return i.value
 }
+
+// setExpireAt changes the deadline of the item, the zero time means it never expires
+func (i *cacheItem[K, V]) setExpireAt(t time.Time) {
+	i.sliding = false // a fixed deadline
+	i.expireAt = t
+	i.lifeSpan = 0
+	if !t.IsZero() {
+		i.lifeSpan = t.Sub(i.createdOn)
+	}
+}
+
+// touch restarts the lifeSpan of the item from now on
+func (i *cacheItem[K, V]) touch(now time.Time) {
+	i.refreshAt = i.refreshAt.Add(now.Sub(i.createdOn))
+	i.createdOn = now
+	i.accessedOn.Store(now.UnixNano())
+	if i.lifeSpan > 0 {
+		i.expireAt = now.Add(i.lifeSpan)
+	}
+}
+
+// refreshing reports whether the item should be reloaded at now
+func (i *cacheItem[K, V]) refreshing(now time.Time) bool {
+	return i.loader != nil && !now.Before(i.refreshAt)
+}
+
+// access records a read of a sliding item, it is safe with the read lock held
+func (i *cacheItem[K, V]) access(now time.Time) {
+	if i.sliding {
+		i.accessedOn.Store(now.UnixNano())
+	}
+}
+
+// deadline returns when the item expires, sliding items are lifeSpan after the last access
+func (i *cacheItem[K, V]) deadline() time.Time {
+	if i.sliding {
+		return time.Unix(0, i.accessedOn.Load()).Add(i.lifeSpan)
+	}
+	return i.expireAt
+}
+
+// expired reports whether the item is past its lifeSpan at now
+func (i *cacheItem[K, V]) expired(now time.Time) bool {
+	return i.lifeSpan > 0 && !now.Before(i.deadline())
+}
@@ -1,354 +1,1030 @@
 package easycache
 
 import (
-	"container/list"
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	defaultInternal = 1 * time.Hour // 这个定时器可以间隔长些
 )
 
-type cacheShard struct {
+type cacheShard[K comparable, V any] struct {
 	lock sync.RWMutex
 
 	// cache
-	items       map[string]*list.Element // all  k/v
-	expireItems map[string]*list.Element // expire k/v  optimize：reduce the number of expire keys scanned
-	list        *list.List
-	cap         uint32 // cache size
+	items       map[K]*cacheItem[K, V] // all  k/v
+	expireItems expireHeap[K, V]       // expire k/v ordered by expireAt  optimize：only expired keys are visited
+	policy      EvictionPolicy[K]      // decide which key is evicted when No space
+	reads       readBuffer[K, V]       // hits of get, applied to policy in batches
+	closed      bool                   // flushed by Close
+	cap         uint32                 // cache size
+	maxBytes    int64                  // max weight
+	weight      int64                  // weight of all items
+	weigher     Weigher[K, V]
+
+	stats shardStats
+	// load notify
+	loads       singleflight.Group
+	loadTimeout time.Duration
+
+	// negative cache
+	negatives   int // number of items holding an error
+	negativeTTL time.Duration
+	cacheError  func(err error) bool
+
+	// stale-while-revalidate
+	staleTTL     time.Duration
+	refreshAhead time.Duration
+
+	version uint64 // the last version given to an item, it only grows so versions are never reused
+
+	// sliding expiration
+	sliding       bool
+	slidingExists bool
 
 	// log
 	logger    Logger
 	isVerbose bool
 
-	// timer
-	cleanupTicker   *time.Ticker
-	cleanupInterval time.Duration
-
-	// add notify
-	addChan chan string
+	// expire notify
+	janitor *janitor[K, V]
 
-	id       int
-	onRemove OnRemoveCallback
-	// close
-	close chan struct{}
+	id        int
+	onRemoval RemovalListener[K, V]
+	removals  *dispatcher[K, V] // nil if onRemoval is invoked under the lock
+	events    *hub[K, V]
+	aof       *aof[K, V] // nil if not enabled
 }
 
 // shard
-func newCacheShard(conf Config, id int, onRemove OnRemoveCallback, close chan struct{}) *cacheShard {
-
-	shard := &cacheShard{
-		items:           make(map[string]*list.Element),
-		expireItems:     make(map[string]*list.Element),
-		cap:             conf.Cap,
-		list:            list.New(),
-		logger:          newLogger(conf.Logger),
-		cleanupInterval: defaultInternal,
-		cleanupTicker:   time.NewTicker(defaultInternal),
-		addChan:         make(chan string),
-		isVerbose:       conf.Verbose,
-		id:              id,
-		onRemove:        onRemove,
-		close:           close,
-	}
-	// goroutine clean expired key
-	go shard.expireCleanup()
+func newCacheShard[K comparable, V any](conf CacheConfig[K, V], id int, onRemoval RemovalListener[K, V], removals *dispatcher[K, V], events *hub[K, V], janitor *janitor[K, V]) *cacheShard[K, V] {
+
+	shard := &cacheShard[K, V]{
+		items:       make(map[K]*cacheItem[K, V]),
+		cap:         conf.Cap,
+		maxBytes:    shardMaxBytes(conf),
+		weigher:     conf.Weigher,
+		policy:      newEvictionPolicy(conf),
+		logger:      newLogger(conf.Logger),
+		janitor:     janitor,
+		isVerbose:   conf.Verbose,
+		id:          id,
+		onRemoval:   onRemoval,
+		removals:    removals,
+		events:      events,
+		loadTimeout: conf.LoadTimeout,
+		negativeTTL: conf.NegativeTTL,
+		cacheError:  conf.CacheError,
+
+		staleTTL:     conf.StaleTTL,
+		refreshAhead: conf.RefreshAhead,
+
+		sliding:       conf.Sliding,
+		slidingExists: conf.SlidingExists,
+	}
+	if shard.cacheError == nil {
+		shard.cacheError = isNotFound
+	}
+	// janitor clean expired key
+	janitor.shards = append(janitor.shards, shard)
 	return shard
 }
 
 // clean cache
-func (cs *cacheShard) flush() {
+func (cs *cacheShard[K, V]) flush() {
 	cs.lock.Lock()
 	defer cs.lock.Unlock()
-	cs.cleanupTicker.Stop()
+	cs.closed = true
 	cs.expireItems = nil
 	cs.items = nil
-	cs.list = nil
+	cs.policy = nil
 }
 
-/*
-1.当定时器到期，执行过期清理
-2.当新增的key有过期时间，通过addChan触发执行
-*/
-func (cs *cacheShard) expireCleanup() {
-
+// cleanup del expired k/v and returns the interval until the next key expires, must hold the write lock
+func (cs *cacheShard[K, V]) cleanup(now time.Time) time.Duration {
 	for {
-		select {
-		case <-cs.cleanupTicker.C:
-		case <-cs.addChan: // 立即触发
-
-		case <-cs.close: // stop goroutine
-			if cs.isVerbose {
-				cs.logger.Printf("[shard %d] flush..", cs.id)
+		item := cs.expireItems.peek() // 最早过期的key
+		if item == nil {
+			return defaultInternal
+		}
+		if !item.expired(now) {
+			if deadline := item.deadline(); deadline.After(item.expireAt) { // sliding item accessed since it was scheduled
+				item.expireAt = deadline
+				cs.expireItems.update(item)
+				continue
 			}
-			cs.flush() // free
-			return
+			// 记录下一次定时器的最小间隔（目的：key过期了，尽快删除）
+			return item.expireAt.Sub(now)
 		}
-		cs.cleanupTicker.Stop()
+		cs.expire(item)
+	}
+}
 
-		// 记录下一次定时器的最小间隔（目的：key过期了，尽快删除）
-		smallestInternal := 0 * time.Second
-		now := time.Now()
-		cs.lock.Lock()
+func (cs *cacheShard[K, V]) set(key K, value V, lifeSpan time.Duration) error {
+	return cs.setSliding(key, value, lifeSpan, cs.sliding)
+}
 
-		for key, ele := range cs.expireItems { // 遍历过期key
+func (cs *cacheShard[K, V]) setSliding(key K, value V, lifeSpan time.Duration, sliding bool) error {
 
-			item := ele.Value.(*cacheItem)
-			if item.LifeSpan() == 0 { // 没有过期时间
-				cs.logger.Printf("warning wrong data\n")
-				continue
-			}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.put(key, value, lifeSpan, sliding)
+}
 
-			if now.Sub(item.CreatedOn()) >= item.LifeSpan() { // 过期
-				// del
-				delete(cs.items, key)
-				delete(cs.expireItems, key)
-				cs.list.Remove(ele)
-				cs.onRemove(key, item.Value(), Expired)
+// mset sets keys[i] to values[i] for i in idx, errs[i] is the error of keys[i]
+func (cs *cacheShard[K, V]) mset(keys []K, values []V, idx []int, lifeSpan time.Duration, errs []error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	for _, i := range idx {
+		errs[i] = cs.put(keys[i], values[i], lifeSpan, cs.sliding)
+	}
+}
 
-				if cs.isVerbose {
-					cs.logger.Printf("[shard %d]: expire del key <%s>  createdOn:%v,  lifeSpan:%d ms \n", cs.id, key, item.CreatedOn(), item.LifeSpan().Milliseconds())
-				}
-			} else {
-				d := item.LifeSpan() - now.Sub(item.CreatedOn())
-				if smallestInternal == 0 || d < smallestInternal {
-					smallestInternal = d
-				}
-			}
+// put sets the key whether it exists or not, must hold the write lock
+func (cs *cacheShard[K, V]) put(key K, value V, lifeSpan time.Duration, sliding bool) error {
+	var err error
+	oldItem, ok := cs.items[key]
+	if ok { // old item
+		err = cs.update(oldItem, value, lifeSpan)
+	} else { // new item
+		err = cs.add(key, value, lifeSpan)
+	}
+	if item := cs.items[key]; err == nil && item.sliding != sliding {
+		item.sliding = sliding
+		cs.journal(item)
+	}
+	return err
+}
 
-		}
+// update modify value and lifeSpan of an existing item, must hold the write lock
+func (cs *cacheShard[K, V]) update(item *cacheItem[K, V], value V, lifeSpan time.Duration) error {
+	negative := item.err != nil
+	if err := cs.setValue(item, value); err != nil {
+		return err
+	}
 
-		if smallestInternal == 0 {
-			smallestInternal = defaultInternal
-		}
-		cs.cleanupInterval = smallestInternal
-		cs.cleanupTicker.Reset(cs.cleanupInterval)
-		cs.lock.Unlock()
+	if negative { // negative cache becomes a normal k/v
+		cs.negatives--
+	}
+	item.reset(value, lifeSpan)
+	item.sliding = cs.sliding
+	cs.scheduleExpire(item)
+	cs.journal(item)
+
+	if cs.isVerbose {
+		cs.logSet(item.Key(), lifeSpan)
+	}
+	return nil
+}
+
+// replace modify the value of an existing item and keeps its lifeSpan, must hold the write lock
+func (cs *cacheShard[K, V]) replace(item *cacheItem[K, V], value V) error {
+	if err := cs.setValue(item, value); err != nil {
+		return err
 	}
+	cs.journal(item)
+	return nil
 }
 
-func (cs *cacheShard) set(key string, value interface{}, lifeSpan time.Duration) error {
+// setValue modify the value of an existing item, must hold the write lock
+func (cs *cacheShard[K, V]) setValue(item *cacheItem[K, V], value V) error {
+	key := item.Key()
+	weight := cs.weigh(key, value)
+	if cs.maxBytes > 0 && weight > cs.maxBytes {
+		return ErrEntryTooLarge
+	}
+
+	event := Updated
+	if item.err != nil { // negative cache becomes a normal k/v
+		event = Created
+	}
+	item.value = value
+	cs.weight += weight - item.weight
+	item.weight = weight
+	cs.version++
+	item.version = cs.version
+	cs.stats.sets.Add(1)
+	cs.policy.OnAccess(key)
+	cs.evict(key, 0, 0) // it may be heavier than before
+	cs.publish(event, item, 0)
+	return nil
+}
 
+// incr replaces the value of the key with f(old value) and keeps its lifeSpan, a missing key is created with lifeSpan
+func (cs *cacheShard[K, V]) incr(key K, lifeSpan time.Duration, f func(old interface{}) (interface{}, error)) error {
 	cs.lock.Lock()
 	defer cs.lock.Unlock()
 
-	oldEle, ok := cs.items[key]
-	if ok { // old item
-		oldItem := oldEle.Value.(*cacheItem)
-		oldLifeSpan := oldItem.LifeSpan()
+	var old V
+	item, ok := cs.alive(key)
+	if ok {
+		old = item.Value()
+	}
+	newValue, err := f(old)
+	if err != nil {
+		return err
+	}
+	value, isV := newValue.(V)
+	if !isV {
+		return ErrNotNumeric
+	}
+
+	if ok {
+		return cs.replace(item, value)
+	}
+	return cs.add(key, value, lifeSpan)
+}
+
+/*
+Loader runs without holding the lock, so a slow load only blocks the callers of the same key.
+Concurrent callers of the same key share a single load through singleflight.
+The load does not stop with ctx of the first caller, it is only bounded by loadTimeout.
+*/
+func (cs *cacheShard[K, V]) getIfNotExist(ctx context.Context, key K, loader TTLLoader[K, V]) (V, error) {
+	if value, _, ok, err := cs.lookup(key, true); ok {
+		return value, err
+	}
+
+	if cs.loadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.loadTimeout)
+		defer cancel()
+	}
 
-		// modify
-		oldEle.Value = newCacheItem(key, value, lifeSpan)
-		cs.list.MoveToFront(oldEle)
+	ch := cs.loads.DoChan(flightKey(key), cs.load(ctx, key, loader))
+	select {
+	case res := <-ch:
+		value, _ := res.Val.(V)
+		return value, res.Err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
 
-		if oldLifeSpan > 0 && lifeSpan == 0 { // 原来的有过期时间，新的没有过期时间
-			delete(cs.expireItems, key)
+// callLoader turns a panic of the loader into an error, singleflight would raise it again on a goroutine nobody can recover
+func callLoader[K comparable, V any](ctx context.Context, key K, loader TTLLoader[K, V]) (value V, ttl time.Duration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrLoaderPanic, r)
 		}
+	}()
+	return loader.LoadWithTTL(ctx, key)
+}
 
-		if oldLifeSpan == 0 && lifeSpan > 0 { // 原有的无过期时间，当前有过期时间
-			cs.expireItems[key] = oldEle
-			if lifeSpan < cs.cleanupInterval {
-				go func() {
-					cs.addChan <- key
-				}()
-			}
+// refresh reloads the key in the background, concurrent reads of a stale key share one load
+func (cs *cacheShard[K, V]) refresh(key K, loader TTLLoader[K, V]) {
+	cs.loads.DoChan(flightKey(key), cs.load(context.Background(), key, loader))
+}
+
+// load returns the singleflight function that loads the key and caches the result
+func (cs *cacheShard[K, V]) load(ctx context.Context, key K, loader TTLLoader[K, V]) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		loadCtx := context.Context(detachedContext{ctx})
+		if cs.loadTimeout > 0 {
+			var cancel context.CancelFunc
+			loadCtx, cancel = context.WithTimeout(loadCtx, cs.loadTimeout)
+			defer cancel()
 		}
 
-	} else { // new item
+		start := time.Now()
+		value, ttl, err := callLoader(loadCtx, key, loader)
+		cs.stats.load(start, err)
+		if err != nil && (cs.negativeTTL <= 0 || !cs.cacheError(err)) {
+			return nil, err
+		}
 
-		if len(cs.items) >= int(cs.cap) { // lru: No space
-			delVal := cs.list.Remove(cs.list.Back())
-			item := delVal.(*cacheItem)
-			delete(cs.items, item.Key())
-			if item.LifeSpan() > 0 {
-				delete(cs.expireItems, item.Key())
-			}
-			cs.onRemove(key, item.Value(), NoSpace)
+		store := err == nil && ttl > 0 // the data source may tell not to cache the value
+		lifeSpan := ttl
+		if ttl == NoExpiration {
+			lifeSpan, ttl = 0, 0
+		} else if ttl > 0 {
+			lifeSpan += cs.staleTTL // hard TTL
+		}
 
-			if cs.isVerbose {
-				cs.logger.Printf("[shard %d] no space del key <%s>\n", cs.id, item.Key())
-			}
+		cs.lock.Lock()
+		defer cs.lock.Unlock()
+		if cs.closed { // loads run on their own goroutine, they may finish after Close
+			return value, err
 		}
-		// add
-		ele := cs.list.PushFront(newCacheItem(key, value, lifeSpan))
-		cs.items[key] = ele
-		if lifeSpan > 0 {
-			cs.expireItems[key] = ele
-			if lifeSpan < cs.cleanupInterval {
-				go func() {
-					cs.addChan <- key
-				}()
+		if oldItem, ok := cs.items[key]; ok {
+			now := time.Now()
+			if !oldItem.expired(now) && oldItem.err == nil {
+				// set by someone else while loading, or keep the stale value if the reload failed
+				if !oldItem.refreshing(now) || err != nil {
+					cs.policy.OnAccess(key)
+					return oldItem.Value(), nil
+				}
+				if !store { // the stale value is not served any more
+					cs.expire(oldItem)
+					return value, nil
+				}
+				if err := cs.update(oldItem, value, lifeSpan); err != nil {
+					return value, nil
+				}
+				cs.setLoader(oldItem, loader, ttl)
+				return value, nil
 			}
+			cs.discard(oldItem)
 		}
-	}
 
-	if cs.isVerbose {
-		if lifeSpan == 0 {
-			cs.logger.Printf("[shard %d]: set persist key <%s>\n", cs.id, key)
-		} else {
-			cs.logger.Printf("[shard %d]: set expired key <%s>", cs.id, key)
+		if err != nil {
+			cs.addNegative(key, err)
+			return nil, err
 		}
+		if !store {
+			return value, nil
+		}
+		// set, a value larger than maxBytes is returned without caching
+		if cs.add(key, value, lifeSpan) == nil {
+			cs.setLoader(cs.items[key], loader, ttl)
+		}
+		return value, nil
 	}
-	return nil
 }
 
-func (cs *cacheShard) getIfNotExist(key string, g Getter, lifeSpan time.Duration) (interface{}, error) {
-	cs.lock.Lock()
-	defer cs.lock.Unlock()
-	oldEle, ok := cs.items[key]
-	if ok {
-		cs.list.MoveToFront(oldEle) // lru : move to front
-		return oldEle.Value.(*cacheItem).Value(), nil
+// setLoader remembers the loader of the item to reload it after its soft TTL, must hold the write lock
+func (cs *cacheShard[K, V]) setLoader(item *cacheItem[K, V], loader TTLLoader[K, V], ttl time.Duration) {
+	if ttl <= 0 || (cs.staleTTL <= 0 && cs.refreshAhead <= 0) {
+		return
 	}
+	item.loader = loader
+	item.refreshAt = item.CreatedOn().Add(ttl - cs.refreshAhead)
+}
 
-	value, err := g.Get(key)
-	if err != nil {
-		return nil, err
+func (cs *cacheShard[K, V]) get(key K) (V, error) {
+	if value, _, ok, _ := cs.lookup(key, false); ok {
+		return value, nil
+	}
+	var zero V
+	return zero, ErrKeyNotExist
+}
+
+// mget looks up keys[i] for i in idx under one read lock, values[i] and errs[i] are the result of keys[i]
+func (cs *cacheShard[K, V]) mget(keys []K, idx []int, now time.Time, values []V, errs []error) {
+	type refresh struct {
+		key    K
+		loader TTLLoader[K, V]
 	}
+	var (
+		expired   []K
+		refreshes []refresh
+		hits      int64
+		full      bool
+	)
 
-	// set
-	if len(cs.items) >= int(cs.cap) { //lru: No space
-		delVal := cs.list.Remove(cs.list.Back())
-		item := delVal.(*cacheItem)
-		delete(cs.items, item.Key())
-		if item.LifeSpan() > 0 {
-			delete(cs.expireItems, item.Key())
+	cs.lock.RLock()
+	for _, i := range idx {
+		item, ok := cs.items[keys[i]]
+		if !ok || item.err != nil || item.expired(now) {
+			if ok && item.expired(now) {
+				expired = append(expired, keys[i])
+			}
+			errs[i] = ErrKeyNotExist
+			continue
 		}
-		if cs.isVerbose {
-			cs.logger.Printf("[shard %d] no space del key <%s>\n", cs.id, item.Key())
+		values[i] = item.Value()
+		if item.refreshing(now) {
+			refreshes = append(refreshes, refresh{keys[i], item.loader})
 		}
-		cs.onRemove(key, item.Value(), NoSpace)
+		item.access(now)
+		full = cs.reads.add(item) || full
+		hits++
 	}
-	// add
-	ele := cs.list.PushFront(newCacheItem(key, value, lifeSpan))
-	cs.items[key] = ele
-	if lifeSpan > 0 {
-		cs.expireItems[key] = ele
-		if lifeSpan < cs.cleanupInterval {
-			go func() {
-				cs.addChan <- key
-			}()
-		}
+	cs.lock.RUnlock()
+	if hits > 0 {
+		cs.stats.hits.Add(hits)
 	}
-	// log
-	if cs.isVerbose {
-		if lifeSpan == 0 {
-			cs.logger.Printf("[shard %d]: set persist key <%s>\n", cs.id, key)
-		} else {
-			cs.logger.Printf("[shard %d]: set expired key <%s>", cs.id, key)
+	if misses := int64(len(idx)) - hits; misses > 0 {
+		cs.stats.misses.Add(misses)
+	}
+
+	if len(expired) > 0 { // expired but not cleaned up yet
+		cs.lock.Lock()
+		for _, key := range expired {
+			if item, ok := cs.items[key]; ok && item.expired(time.Now()) {
+				cs.expire(item)
+			}
 		}
+		cs.drainReads()
+		cs.lock.Unlock()
+	} else if full && cs.lock.TryLock() {
+		cs.drainReads()
+		cs.lock.Unlock()
 	}
-	return value, nil
+	for _, r := range refreshes {
+		cs.refresh(r.key, r.loader)
+	}
+}
 
+func (cs *cacheShard[K, V]) getWithVersion(key K) (V, uint64, error) {
+	if value, version, ok, _ := cs.lookup(key, false); ok {
+		return value, version, nil
+	}
+	var zero V
+	return zero, 0, ErrKeyNotExist
 }
 
-func (cs *cacheShard) get(key string) (interface{}, error) {
+// lookup returns the value and version if the key exists and is not expired, it only holds the read lock.
+// The cached error of a negative k/v is returned if negative is true, otherwise it is a miss.
+func (cs *cacheShard[K, V]) lookup(key K, negative bool) (V, uint64, bool, error) {
 	cs.lock.RLock()
-	defer cs.lock.RUnlock()
-	ele, ok := cs.items[key]
-	if ok {
-		cs.list.MoveToFront(ele) // lru : move to front
-		return ele.Value.(*cacheItem).Value(), nil
+	now := time.Now()
+	item, ok := cs.items[key]
+	expired := ok && item.expired(now)
+	if ok && !expired && (item.err == nil || negative) {
+		value, version, err := item.Value(), item.version, item.err
+		refresh, loader := item.refreshing(now), item.loader
+		item.access(now)
+		full := cs.reads.add(item) // policy access later
+		cs.lock.RUnlock()
+		cs.stats.hits.Add(1)
+
+		if full && cs.lock.TryLock() { // someone else is writing, it will drain soon
+			cs.drainReads()
+			cs.lock.Unlock()
+		}
+		if refresh { // stale or about to expire
+			cs.refresh(key, loader)
+		}
+		return value, version, true, err
 	}
+	cs.lock.RUnlock()
+	cs.stats.misses.Add(1)
 
-	return nil, ErrKeyNotExist
+	if expired { // expired but not cleaned up yet
+		cs.expireKey(key)
+	}
+	var zero V
+	return zero, 0, false, nil
 }
 
-func (cs *cacheShard) del(key string) error {
+func (cs *cacheShard[K, V]) del(key K) error {
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.erase(key)
+}
 
+// mdel deletes keys[i] for i in idx, errs[i] is the error of keys[i]
+func (cs *cacheShard[K, V]) mdel(keys []K, idx []int, errs []error) {
 	cs.lock.Lock()
 	defer cs.lock.Unlock()
-	ele, ok := cs.items[key]
+	for _, i := range idx {
+		errs[i] = cs.erase(keys[i])
+	}
+}
+
+// erase deletes the key, must hold the write lock
+func (cs *cacheShard[K, V]) erase(key K) error {
+	item, ok := cs.items[key]
 	if !ok {
 		return ErrKeyNotExist
 	}
 
-	// del items
-	delete(cs.items, key)
-	// del list
-	val := cs.list.Remove(ele)
-	item := val.(*cacheItem)
-	// del expireItems
-	if item.LifeSpan() > 0 {
-		delete(cs.expireItems, key)
+	if item.expired(time.Now()) || item.err != nil { // expired but not cleaned up yet, or negative
+		cs.discard(item)
+		return ErrKeyNotExist
 	}
+
+	cs.remove(item)
+	return nil
+
+}
+
+// remove del an item by hand and notify, must hold the write lock
+func (cs *cacheShard[K, V]) remove(item *cacheItem[K, V]) {
+	cs.removeItem(item)
 	// remove callback
-	cs.onRemove(key, item.Value(), Deleted)
+	cs.notifyRemove(item, Deleted)
 	if cs.isVerbose {
-		cs.logger.Printf("[shard %d] manual del key <%s>\n", cs.id, key)
+		cs.logger.Printf("[shard %d] manual del key <%v>\n", cs.id, item.Key())
 	}
-	return nil
+}
+
+// setIf sets the key if cond accepts the current item, which is nil if the key does not exist.
+// keepTTL replaces the value of an existing item without changing its lifeSpan.
+func (cs *cacheShard[K, V]) setIf(key K, value V, lifeSpan time.Duration, keepTTL bool, cond func(item *cacheItem[K, V]) bool) (bool, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	item, _ := cs.alive(key)
+	if !cond(item) {
+		return false, nil
+	}
+
+	var err error
+	switch {
+	case item == nil:
+		err = cs.add(key, value, lifeSpan)
+	case keepTTL:
+		err = cs.replace(item, value)
+	default:
+		err = cs.update(item, value, lifeSpan)
+	}
+	return err == nil, err
+}
+
+// compute runs f with the old value of the key and applies its action, all under the write lock
+func (cs *cacheShard[K, V]) compute(key K, f ComputeFunc[V]) (V, bool, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	var old V
+	item, exists := cs.alive(key)
+	if exists {
+		old = item.Value()
+	}
+
+	value, ttl, action := f(old, exists)
+	switch action {
+	case Replace:
+		var err error
+		switch {
+		case !exists:
+			if ttl < 0 {
+				ttl = 0
+			}
+			err = cs.add(key, value, ttl)
+		case ttl < 0:
+			err = cs.replace(item, value)
+		default:
+			err = cs.update(item, value, ttl)
+		}
+		if err != nil {
+			return old, exists, err
+		}
+		return value, true, nil
+	case Delete:
+		if exists {
+			cs.remove(item)
+		}
+		var zero V
+		return zero, false, nil
+	}
+	return old, exists, nil
+}
 
+// delIf del the key if cond accepts the current item
+func (cs *cacheShard[K, V]) delIf(key K, cond func(item *cacheItem[K, V]) bool) bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	item, ok := cs.alive(key)
+	if !ok || !cond(item) {
+		return false
+	}
+	cs.remove(item)
+	return true
 }
 
-func (cs *cacheShard) count() int {
+func (cs *cacheShard[K, V]) count() int {
 	cs.lock.RLock()
 	defer cs.lock.RUnlock()
-	return len(cs.items)
+	return len(cs.items) - cs.negatives
 }
 
-func (cs *cacheShard) foreach(f func(key string, value interface{})) {
+func (cs *cacheShard[K, V]) foreach(f func(key K, value V)) {
 
 	cs.lock.RLock()
 	defer cs.lock.RUnlock()
 
 	// range all item
-	for key, ele := range cs.items {
-		f(key, ele.Value.(*cacheItem).Value())
+	now := time.Now()
+	for key, item := range cs.items {
+		if item.expired(now) || item.err != nil { // left to expireCleanup
+			continue
+		}
+		f(key, item.Value())
 	}
 }
 
-func (cs *cacheShard) exists(key string) bool {
+func (cs *cacheShard[K, V]) exists(key K) bool {
 	cs.lock.RLock()
-	defer cs.lock.RUnlock()
-	_, ok := cs.items[key]
-	return ok
+	item, ok := cs.items[key]
+	now := time.Now()
+	expired := ok && item.expired(now)
+	negative := ok && item.err != nil
+	if ok && !expired && cs.slidingExists {
+		item.access(now)
+	}
+	cs.lock.RUnlock()
+
+	if expired {
+		cs.expireKey(key)
+		return false
+	}
+	return ok && !negative
+}
+
+func (cs *cacheShard[K, V]) ttl(key K) (time.Duration, error) {
+	cs.lock.RLock()
+	now := time.Now()
+	item, ok := cs.items[key]
+	expired := ok && item.expired(now)
+	var ttl time.Duration
+	if ok && item.LifeSpan() > 0 {
+		ttl = item.deadline().Sub(now)
+	}
+	negative := ok && item.err != nil
+	cs.lock.RUnlock()
+
+	if expired {
+		cs.expireKey(key)
+		return 0, ErrKeyNotExist
+	}
+	if !ok || negative {
+		return 0, ErrKeyNotExist
+	}
+	return ttl, nil
+}
+
+// expireAt changes the deadline of the key, the zero time means it never expires
+func (cs *cacheShard[K, V]) expireAt(key K, t time.Time) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	item, ok := cs.alive(key)
+	if !ok {
+		return ErrKeyNotExist
+	}
+	if !t.IsZero() && !t.After(time.Now()) {
+		cs.expire(item)
+		cs.journalDel(key) // the logged deadline is later
+		return nil
+	}
+
+	item.setExpireAt(t)
+	item.loader = nil // the deadline is not up to the loader any more
+	cs.scheduleExpire(item)
+	cs.journal(item)
+	return nil
+}
+
+// touch restarts the lifeSpan of the key from now on
+func (cs *cacheShard[K, V]) touch(key K) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	item, ok := cs.alive(key)
+	if !ok {
+		return ErrKeyNotExist
+	}
+	item.touch(time.Now())
+	cs.policy.OnAccess(key)
+	cs.scheduleExpire(item)
+	cs.journal(item)
+	return nil
 }
 
-func (cs *cacheShard) getorset(key string, value interface{}, lifeSpan time.Duration) (interface{}, error) {
+func (cs *cacheShard[K, V]) getorset(key K, value V, lifeSpan time.Duration) (V, error) {
 	cs.lock.Lock()
 	defer cs.lock.Unlock()
 
 	// get
-	oldEle, ok := cs.items[key]
+	oldItem, ok := cs.items[key]
 	if ok {
-		cs.list.MoveToFront(oldEle) // lru : move to front
-		return oldEle.Value.(*cacheItem).Value(), nil
+		if now := time.Now(); !oldItem.expired(now) && oldItem.err == nil {
+			cs.stats.hits.Add(1)
+			cs.policy.OnAccess(key)
+			oldItem.access(now)
+			return oldItem.Value(), nil
+		}
+		cs.discard(oldItem) // lazy expire, then set as a new item
 	}
+	cs.stats.misses.Add(1)
 
-	// set
-	if len(cs.items) >= int(cs.cap) { //lru: No space
-		delVal := cs.list.Remove(cs.list.Back())
-		item := delVal.(*cacheItem)
-		delete(cs.items, item.Key())
-		if item.LifeSpan() > 0 {
-			delete(cs.expireItems, item.Key())
-		}
+	// set, a value larger than maxBytes is returned without caching
+	cs.add(key, value, lifeSpan)
+	return value, nil
+}
+
+// add a new k/v, evict keys chosen by policy if No space, must hold the write lock
+func (cs *cacheShard[K, V]) add(key K, value V, lifeSpan time.Duration) error {
+	item, err := cs.insert(key, value, lifeSpan)
+	if err != nil {
+		return err
+	}
+	cs.publish(Created, item, 0)
+	cs.journal(item)
+	return nil
+}
+
+// insert adds a new item without publishing it, must hold the write lock
+func (cs *cacheShard[K, V]) insert(key K, value V, lifeSpan time.Duration) (*cacheItem[K, V], error) {
+	weight := cs.weigh(key, value)
+	if cs.maxBytes > 0 && weight > cs.maxBytes {
 		if cs.isVerbose {
-			cs.logger.Printf("[shard %d] no space del key <%s>\n", cs.id, item.Key())
+			cs.logger.Printf("[shard %d] too large key <%v> weight:%d\n", cs.id, key, weight)
 		}
-		cs.onRemove(key, item.Value(), NoSpace)
+		return nil, ErrEntryTooLarge
+	}
+	if oldItem, ok := cs.items[key]; ok { // expired or negative
+		cs.discard(oldItem)
 	}
+	cs.evict(key, 1, weight)
+
 	// add
-	ele := cs.list.PushFront(newCacheItem(key, value, lifeSpan))
-	cs.items[key] = ele
-	if lifeSpan > 0 {
-		cs.expireItems[key] = ele
-		if lifeSpan < cs.cleanupInterval {
-			go func() {
-				cs.addChan <- key
-			}()
+	item := newCacheItem(key, value, lifeSpan)
+	item.sliding = cs.sliding
+	item.weight = weight
+	cs.items[key] = item
+	cs.weight += weight
+	cs.version++
+	item.version = cs.version
+	cs.stats.sets.Add(1)
+	cs.policy.OnInsert(key)
+	cs.scheduleExpire(item)
+	// log
+	if cs.isVerbose {
+		cs.logSet(key, lifeSpan)
+	}
+	return item, nil
+}
+
+// evict del keys chosen by policy until count more keys of weight fit in, must hold the write lock
+func (cs *cacheShard[K, V]) evict(key K, count int, weight int64) {
+	if !cs.overflow(count, weight) {
+		return
+	}
+
+	cs.drainReads()
+	for len(cs.items) > 0 && cs.overflow(count, weight) { // No space
+		victim, ok := cs.policy.Victim(key)
+		if !ok {
+			return
+		}
+		item := cs.items[victim]
+		cs.removeItem(item)
+		cs.notifyRemove(item, NoSpace)
+
+		if cs.isVerbose {
+			cs.logger.Printf("[shard %d] no space del key <%v>\n", cs.id, item.Key())
 		}
 	}
-	// log
+}
+
+func (cs *cacheShard[K, V]) overflow(count int, weight int64) bool {
+	return (cs.cap > 0 && len(cs.items)+count > int(cs.cap)) ||
+		(cs.maxBytes > 0 && cs.weight+weight > cs.maxBytes)
+}
+
+func (cs *cacheShard[K, V]) weigh(key K, value V) int64 {
+	if cs.weigher == nil {
+		return 0
+	}
+	return cs.weigher(key, value)
+}
+
+func (cs *cacheShard[K, V]) totalWeight() int64 {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.weight
+}
+
+func shardMaxBytes[K comparable, V any](conf CacheConfig[K, V]) int64 {
+	if conf.MaxBytes <= 0 {
+		return 0
+	}
+	if maxBytes := conf.MaxBytes / int64(conf.Shards); maxBytes > 0 {
+		return maxBytes
+	}
+	return 1
+}
+
+func (cs *cacheShard[K, V]) logSet(key K, lifeSpan time.Duration) {
+	if lifeSpan == 0 {
+		cs.logger.Printf("[shard %d]: set persist key <%v>\n", cs.id, key)
+	} else {
+		cs.logger.Printf("[shard %d]: set expired key <%v>", cs.id, key)
+	}
+}
+
+// removeItem del k/v from items、expireItems and policy, must hold the write lock
+func (cs *cacheShard[K, V]) removeItem(item *cacheItem[K, V]) {
+	delete(cs.items, item.Key())
+	cs.weight -= item.weight
+	if item.err != nil {
+		cs.negatives--
+	}
+	cs.expireItems.remove(item)
+	cs.policy.OnRemove(item.Key())
+}
+
+// drainReads applies the hits of get to the policy, must hold the write lock
+func (cs *cacheShard[K, V]) drainReads() {
+	cs.reads.drain(func(item *cacheItem[K, V]) {
+		if cs.items[item.Key()] == item { // still cached
+			cs.policy.OnAccess(item.Key())
+		}
+	})
+}
+
+// scheduleExpire keeps expireItems in sync with the lifeSpan of the item, must hold the write lock
+func (cs *cacheShard[K, V]) scheduleExpire(item *cacheItem[K, V]) {
+	cs.expireItems.update(item)
+	if item.LifeSpan() > 0 {
+		cs.janitor.notify(item.expireAt)
+	}
+}
+
+// notifyRemove counts the removal and invokes the callback, must hold the write lock
+func (cs *cacheShard[K, V]) notifyRemove(item *cacheItem[K, V], reason RemoveReason) {
+	if item.err != nil { // negative cache is invisible
+		return
+	}
+	cs.stats.removed(reason)
+	cs.publish(Removed, item, reason)
+	if reason != Expired { // expired keys are past the logged deadline
+		cs.journalDel(item.Key())
+	}
+	event := RemovalEvent[K, V]{
+		Key:       item.Key(),
+		Value:     item.Value(),
+		Reason:    reason,
+		Shard:     cs.id,
+		CreatedOn: item.CreatedOn(),
+		LifeSpan:  item.LifeSpan(),
+	}
+	if cs.removals == nil {
+		cs.onRemoval(event)
+		return
+	}
+	if dropped := cs.removals.dispatch(event); dropped > 0 {
+		cs.stats.droppedEvents.Add(dropped)
+	}
+}
+
+// publish sends the change of the item to the subscribers, must hold the write lock so that the events of a key are in order
+func (cs *cacheShard[K, V]) publish(typ EventType, item *cacheItem[K, V], reason RemoveReason) {
+	if !cs.events.active() {
+		return
+	}
+	event := Event[K, V]{Type: typ, Key: item.Key(), Value: item.Value(), Reason: reason}
+	if dropped := cs.events.publish(event); dropped > 0 {
+		cs.stats.droppedEvents.Add(dropped)
+	}
+}
+
+// discard del an expired or negative item before it is replaced, must hold the write lock
+func (cs *cacheShard[K, V]) discard(item *cacheItem[K, V]) {
+	if item.expired(time.Now()) {
+		cs.expire(item)
+		return
+	}
+	cs.removeItem(item)
+}
+
+// addNegative caches the error of a loader, must hold the write lock
+func (cs *cacheShard[K, V]) addNegative(key K, err error) {
+	var zero V
+	if item, e := cs.insert(key, zero, cs.negativeTTL); e == nil {
+		item.err = err
+		cs.negatives++
+	}
+}
+
+// expire del an expired k/v and notify, must hold the write lock
+func (cs *cacheShard[K, V]) expire(item *cacheItem[K, V]) {
+	cs.removeItem(item)
+	cs.notifyRemove(item, Expired)
+
 	if cs.isVerbose {
-		if lifeSpan == 0 {
-			cs.logger.Printf("[shard %d]: set persist key <%s>\n", cs.id, key)
-		} else {
-			cs.logger.Printf("[shard %d]: set expired key <%s>", cs.id, key)
+		cs.logger.Printf("[shard %d]: expire del key <%v>  createdOn:%v,  lifeSpan:%d ms \n", cs.id, item.Key(), item.CreatedOn(), item.LifeSpan().Milliseconds())
+	}
+}
+
+// snapshot copies the k/v which are alive at now, copied is called before the lock is released if not nil
+func (cs *cacheShard[K, V]) snapshot(now time.Time, copied func()) []snapshotEntry[K, V] {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	if copied != nil {
+		defer copied()
+	}
+
+	entries := make([]snapshotEntry[K, V], 0, len(cs.items)-cs.negatives)
+	for _, item := range cs.items {
+		if item.expired(now) || item.err != nil {
+			continue
 		}
+		entries = append(entries, entryOf(item))
 	}
-	return value, nil
+	return entries
+}
+
+func entryOf[K comparable, V any](item *cacheItem[K, V]) snapshotEntry[K, V] {
+	entry := snapshotEntry[K, V]{Key: item.Key(), Value: item.Value(), LifeSpan: item.LifeSpan(), Sliding: item.sliding}
+	if item.LifeSpan() > 0 {
+		entry.ExpireAt = item.deadline()
+	}
+	return entry
+}
+
+// restore sets a k/v of a snapshot with its remaining TTL
+func (cs *cacheShard[K, V]) restore(entry snapshotEntry[K, V], now time.Time) error {
+	lifeSpan := entry.LifeSpan
+	if !entry.ExpireAt.IsZero() {
+		if !entry.ExpireAt.After(now) {
+			return nil
+		}
+		if !entry.Sliding {
+			lifeSpan = entry.ExpireAt.Sub(now)
+		}
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if err := cs.put(entry.Key, entry.Value, lifeSpan, entry.Sliding); err != nil {
+		return err
+	}
+	if item := cs.items[entry.Key]; entry.Sliding && lifeSpan > 0 { // last accessed before the snapshot
+		item.accessedOn.Store(entry.ExpireAt.Add(-lifeSpan).UnixNano())
+		item.expireAt = entry.ExpireAt
+		cs.scheduleExpire(item)
+		cs.journal(item)
+	}
+	return nil
+}
+
+// replay applies a record of the append-only file
+func (cs *cacheShard[K, V]) replay(record aofRecord[K, V], now time.Time) error {
+	entry := record.Entry
+	if record.Op == aofSet && (entry.ExpireAt.IsZero() || entry.ExpireAt.After(now)) {
+		return cs.restore(entry, now)
+	}
+
+	// deleted or expired
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if item, ok := cs.items[entry.Key]; ok {
+		cs.removeItem(item)
+	}
+	return nil
+}
+
+// journal logs the item to the append-only file, must hold the write lock so that the records of a key are in order
+func (cs *cacheShard[K, V]) journal(item *cacheItem[K, V]) {
+	if cs.aof == nil || item.err != nil {
+		return
+	}
+	cs.aof.append(cs.id, aofRecord[K, V]{Op: aofSet, Entry: entryOf(item)})
+}
+
+// journalDel logs the removal of the key, must hold the write lock
+func (cs *cacheShard[K, V]) journalDel(key K) {
+	if cs.aof == nil {
+		return
+	}
+	cs.aof.append(cs.id, aofRecord[K, V]{Op: aofDel, Entry: snapshotEntry[K, V]{Key: key}})
+}
+
+// alive returns the item if the key exists and is not expired or negative, must hold the write lock
+func (cs *cacheShard[K, V]) alive(key K) (*cacheItem[K, V], bool) {
+	item, ok := cs.items[key]
+	if !ok || item.err != nil {
+		return nil, false
+	}
+	if item.expired(time.Now()) {
+		cs.expire(item)
+		return nil, false
+	}
+	return item, true
+}
+
+// expireKey del the key if it is expired (read paths only hold the read lock when they find it)
+func (cs *cacheShard[K, V]) expireKey(key K) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	item, ok := cs.items[key]
+	if ok && item.expired(time.Now()) {
+		cs.expire(item)
+	}
+}
+
+// flightKey maps the key to the string key of singleflight
+func flightKey[K comparable](key K) string {
+	if s, ok := interface{}(key).(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%#v", key)
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// equal compares two values with ==, values which are not comparable (slices, maps...) are never equal
+func equal[V any](a, b V) (eq bool) {
+	defer func() {
+		if recover() != nil {
+			eq = false
+		}
+	}()
+	return interface{}(a) == interface{}(b)
 }
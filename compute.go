@@ -0,0 +1,21 @@
+package easycache
+
+import "time"
+
+// Action tells Compute what to do with the value returned by the user function
+type Action uint32
+
+const (
+	// Keep leaves the key as it is
+	Keep = Action(0)
+	// Replace sets the returned value, the key is created if it does not exist
+	Replace = Action(1)
+	// Delete removes the key, the removal callback is called with Deleted
+	Delete = Action(2)
+)
+
+// KeepTTL can be returned as the ttl of Replace to keep the TTL of an existing key, a new key never expires
+const KeepTTL = time.Duration(-1)
+
+// ComputeFunc computes the new value of a key from the old one, exists is false if the key does not exist
+type ComputeFunc[V any] func(old V, exists bool) (newValue V, ttl time.Duration, action Action)
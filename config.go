@@ -2,6 +2,7 @@ package easycache
 
 import (
 	"fmt"
+	"time"
 )
 
 type RemoveReason uint32
@@ -16,27 +17,123 @@ const (
 	Deleted = RemoveReason(3)
 )
 
-type OnRemoveCallback func(key string, value interface{}, reason RemoveReason)
+// RemoveCallback is invoked when a key is removed from a Cache[K, V]
+type RemoveCallback[K comparable, V any] func(key K, value V, reason RemoveReason)
 
-type Config struct {
+// OnRemoveCallback is invoked when a key is removed from an EasyCache
+type OnRemoveCallback = RemoveCallback[string, interface{}]
+
+// RemovalEvent describes a removed k/v
+type RemovalEvent[K comparable, V any] struct {
+	Key       K
+	Value     V
+	Reason    RemoveReason
+	Shard     int // id of the shard the key was in
+	CreatedOn time.Time
+	LifeSpan  time.Duration
+}
+
+// RemovalListener is invoked with the details of every removed k/v
+type RemovalListener[K comparable, V any] func(event RemovalEvent[K, V])
+
+// Listener adapts a RemoveCallback to a RemovalListener
+func (f RemoveCallback[K, V]) Listener() RemovalListener[K, V] {
+	return func(event RemovalEvent[K, V]) {
+		f(event.Key, event.Value, event.Reason)
+	}
+}
+
+// CacheConfig is the configuration of a Cache[K, V]
+type CacheConfig[K comparable, V any] struct {
 	// Number of cache shards, value must be a power of two
 	Shards int
-	// Number of key in signal cache shards
+	// Number of key in signal cache shards, 0 means no limit if MaxBytes is set
 	Cap uint32
-	// Hasher used to map between string keys and unsigned 64bit integers, by default fnv64 hashing is used.
-	Hasher Hasher
+	// Total weight of the cache, every shard gets MaxBytes/Shards. 0 means no limit
+	MaxBytes int64
+	// Weigher returns the weight of a k/v, by default string and []byte weigh their length and other values weigh 1.
+	// The weight is only tracked if either MaxBytes or Weigher is set.
+	Weigher Weigher[K, V]
+	// Hasher used to map between keys and unsigned 64bit integers, by default fnv64 hashing is used for string keys.
+	// It is required for any other key type.
+	Hasher KeyHasher[K]
+
+	// Eviction selects the built-in policy used when a shard has No space, default is EvictLRU
+	Eviction EvictionKind
+	// NewEvictionPolicy creates a custom policy for every shard, it takes precedence over Eviction
+	NewEvictionPolicy func() EvictionPolicy[K]
+
+	// LoadTimeout bounds every load of GetIfNotExist and GetIfNotExistCtx, 0 means no timeout
+	LoadTimeout time.Duration
+
+	// NegativeTTL caches the errors of loaders for this long, so that GetIfNotExist returns them without loading again.
+	// 0 disables negative caching
+	NegativeTTL time.Duration
+	// CacheError reports whether an error of a loader is negative cached, by default only ErrNotFound is cached
+	CacheError func(err error) bool
+
+	// StaleTTL keeps the values loaded by GetIfNotExist for this long after their TTL (the soft TTL).
+	// Reads in between return the stale value at once and reload it in the background. 0 disables
+	StaleTTL time.Duration
+	// RefreshAhead reloads the values loaded by GetIfNotExist in the background when they are read this long before their TTL
+	RefreshAhead time.Duration
+
+	// Sliding makes keys expire lifeSpan after the last Get instead of after Set
+	Sliding bool
+	// SlidingExists makes Exists restart the lifeSpan of sliding keys as well
+	SlidingExists bool
+
+	// Number of goroutines cleaning expired keys, each of them serves Shards/Janitors shards. Default is 1.
+	Janitors int
 
 	Logger  Logger
 	Verbose bool
 
-	OnRemoveWithReason OnRemoveCallback
+	// OnRemoveWithReason is invoked with the key, value and reason of every removal
+	OnRemoveWithReason RemoveCallback[K, V]
+	// OnRemoval is invoked with the RemovalEvent of every removal, after OnRemoveWithReason if both are set
+	OnRemoval RemovalListener[K, V]
+
+	// RemovalWorkers > 0 invokes the removal callbacks on this many goroutines instead of under the shard lock,
+	// so that they may be slow or call the cache. The events of a shard are handled by one worker in order.
+	RemovalWorkers int
+	// RemovalQueueSize is the capacity of the queue of every worker, default is 1024
+	RemovalQueueSize int
+	// RemovalOverflow decides what happens to an event when the queue is full, default is OverflowDrop
+	RemovalOverflow OverflowPolicy
+
+	// SnapshotPath is loaded when the cache is created, and saved every SnapshotInterval and on Close. Empty disables
+	SnapshotPath string
+	// SnapshotInterval of the background snapshots, default is 1 minute
+	SnapshotInterval time.Duration
+	// Codec encodes the snapshots and the append-only file, default is GobCodec
+	Codec Codec
+
+	// AOFPath is an append-only file of the writes, it is replayed when the cache is created. Empty disables.
+	// Once the file exists SnapshotPath is not loaded any more, the file is rewritten from the live k/v instead.
+	// Reads of sliding keys are not logged, they may expire earlier after a restart.
+	AOFPath string
+	// AOFSync decides how often the file is fsynced, default is SyncEverySecond
+	AOFSync SyncPolicy
+	// AOFRewriteSize starts a background rewrite of the file from the live k/v once it is this large
+	// and twice the size after the last rewrite, default is 64MB
+	AOFRewriteSize int64
 }
 
+// Config is the configuration of an EasyCache
+type Config = CacheConfig[string, interface{}]
+
 func DefaultConfig() Config {
-	return Config{
+	return DefaultCacheConfig[string, interface{}]()
+}
+
+// DefaultCacheConfig returns the default configuration of a Cache[K, V].
+// Hasher is only filled in when K is string.
+func DefaultCacheConfig[K comparable, V any]() CacheConfig[K, V] {
+	return CacheConfig[K, V]{
 		Shards:  1024,
 		Cap:     32,
-		Hasher:  newDefaultHasher(),
+		Hasher:  defaultKeyHasher[K](),
 		Logger:  DefaultLogger(),
 		Verbose: false,
 	}
@@ -54,3 +151,11 @@ func TestConfig() Config {
 		},
 	}
 }
+
+// defaultKeyHasher returns the fnv64 hasher if K is string, otherwise nil
+func defaultKeyHasher[K comparable]() KeyHasher[K] {
+	if h, ok := interface{}(newDefaultHasher()).(KeyHasher[K]); ok {
+		return h
+	}
+	return nil
+}
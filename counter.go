@@ -0,0 +1,64 @@
+package easycache
+
+type integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// incrInt adds delta to an integer value and keeps its type, nil is created as int64
+func incrInt(value interface{}, delta int64) (interface{}, int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return delta, delta, nil
+	case int:
+		return incrInteger(v, delta)
+	case int8:
+		return incrInteger(v, delta)
+	case int16:
+		return incrInteger(v, delta)
+	case int32:
+		return incrInteger(v, delta)
+	case int64:
+		return incrInteger(v, delta)
+	case uint:
+		return incrInteger(v, delta)
+	case uint8:
+		return incrInteger(v, delta)
+	case uint16:
+		return incrInteger(v, delta)
+	case uint32:
+		return incrInteger(v, delta)
+	case uint64:
+		return incrInteger(v, delta)
+	}
+	return nil, 0, ErrNotNumeric
+}
+
+func incrInteger[T integer](v T, delta int64) (interface{}, int64, error) {
+	old := int64(v)
+	if (old < 0) != (v < 0) { // uint64 larger than MaxInt64
+		return nil, 0, ErrOverflow
+	}
+	n := old + delta
+	if (n > old) != (delta > 0) || int64(T(n)) != n || (T(n) < 0) != (n < 0) {
+		return nil, 0, ErrOverflow
+	}
+	return T(n), n, nil
+}
+
+// incrFloat adds delta to a number, floats keep their type and the others become float64
+func incrFloat(value interface{}, delta float64) (interface{}, float64, error) {
+	switch v := value.(type) {
+	case float64:
+		n := v + delta
+		return n, n, nil
+	case float32:
+		n := float32(float64(v) + delta)
+		return n, float64(n), nil
+	}
+	_, old, err := incrInt(value, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := float64(old) + delta
+	return n, n, nil
+}
@@ -0,0 +1,97 @@
+package easycache
+
+// OverflowPolicy decides what the async removal dispatcher does when a queue is full
+type OverflowPolicy uint32
+
+const (
+	// OverflowDrop drops the new event, it is counted in Stats.DroppedEvents
+	OverflowDrop = OverflowPolicy(0)
+	// OverflowBlock waits for room in the queue while holding the shard lock, no event is lost.
+	// The callbacks must not call the cache then: a worker waiting for the shard lock never makes room.
+	OverflowBlock = OverflowPolicy(1)
+	// OverflowDropOldest drops the oldest event in the queue to make room, it is counted in Stats.DroppedEvents
+	OverflowDropOldest = OverflowPolicy(2)
+)
+
+const defaultRemovalQueueSize = 1024
+
+// dispatcher invokes the removal listener on worker goroutines, each shard is served by one worker in order
+type dispatcher[K comparable, V any] struct {
+	queues   []chan RemovalEvent[K, V]
+	listener RemovalListener[K, V]
+	overflow OverflowPolicy
+
+	// close
+	close chan struct{}
+}
+
+func newDispatcher[K comparable, V any](conf CacheConfig[K, V], listener RemovalListener[K, V], close chan struct{}) *dispatcher[K, V] {
+	size := conf.RemovalQueueSize
+	if size <= 0 {
+		size = defaultRemovalQueueSize
+	}
+	d := &dispatcher[K, V]{
+		queues:   make([]chan RemovalEvent[K, V], conf.RemovalWorkers),
+		listener: listener,
+		overflow: conf.RemovalOverflow,
+		close:    close,
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan RemovalEvent[K, V], size)
+		go d.run(d.queues[i])
+	}
+	return d
+}
+
+// dispatch queues the event, it returns the number of dropped events
+func (d *dispatcher[K, V]) dispatch(event RemovalEvent[K, V]) int64 {
+	queue := d.queues[event.Shard%len(d.queues)]
+	switch d.overflow {
+	case OverflowDrop:
+		select {
+		case queue <- event:
+			return 0
+		default:
+			return 1
+		}
+	case OverflowDropOldest:
+		var dropped int64
+		for {
+			select {
+			case queue <- event:
+				return dropped
+			default:
+			}
+			select {
+			case <-queue:
+				dropped++
+			default: // the worker made room
+			}
+		}
+	}
+
+	select {
+	case queue <- event:
+		return 0
+	case <-d.close: // nobody would receive it
+		return 1
+	}
+}
+
+func (d *dispatcher[K, V]) run(queue chan RemovalEvent[K, V]) {
+	for {
+		select {
+		case event := <-queue:
+			d.listener(event)
+		case <-d.close: // handle the events left, then stop goroutine
+			for {
+				select {
+				case event := <-queue:
+					d.listener(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package easycache
+
+type Getter interface {
+	Get(string) (interface{}, error)
+}
+
+type GetterFunc func(string) (interface{}, error)
+
+func (g GetterFunc) Get(key string) (interface{}, error) {
+	return g(key)
+}
+
+// EasyCache is the interface{} flavour of Cache, keyed by string.
+// Every Getter is a Loader[string, interface{}], so all methods are inherited from Cache.
+type EasyCache struct {
+	*Cache[string, interface{}]
+}
+
+// New initialize new instance of EasyCache
+func New(conf Config) (*EasyCache, error) {
+	cache, err := NewCache[string, interface{}](conf)
+	if err != nil {
+		return nil, err
+	}
+	return &EasyCache{Cache: cache}, nil
+}
@@ -3,3 +3,17 @@ package easycache
 import "errors"
 
 var ErrKeyNotExist = errors.New("key not exists")
+
+// ErrNotFound can be returned by loaders when the key does not exist in the data source, it is negative cached by default
+var ErrNotFound = errors.New("not found")
+
+var ErrEntryTooLarge = errors.New("entry is larger than the max bytes of a shard")
+
+// ErrLoaderPanic is returned to all the callers waiting for a loader which panicked
+var ErrLoaderPanic = errors.New("loader panicked")
+
+// ErrNotNumeric is returned by Incr and Decr when the value is not a number
+var ErrNotNumeric = errors.New("value is not a number")
+
+// ErrOverflow is returned by Incr and Decr when the result does not fit the type of the value
+var ErrOverflow = errors.New("increment or decrement would overflow")
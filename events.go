@@ -0,0 +1,143 @@
+package easycache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// EventType is the kind of change of a key, the types can be or'ed in an EventFilter
+type EventType uint32
+
+const (
+	// Created means a key which did not exist is set
+	Created = EventType(1 << iota)
+	// Updated means the value of an existing key is changed
+	Updated
+	// Removed means a key is removed, Event.Reason tells why
+	Removed
+)
+
+const defaultEventBuffer = 128
+
+// Event is a change of the cache sent to subscribers
+type Event[K comparable, V any] struct {
+	Type   EventType
+	Key    K
+	Value  V
+	Reason RemoveReason // only for Removed
+}
+
+// EventFilter selects the events of a subscription
+type EventFilter struct {
+	// Types of the events, 0 means all of them
+	Types EventType
+	// KeyPrefix only selects the string keys starting with it
+	KeyPrefix string
+	// Buffer is the capacity of the channel, default is 128
+	Buffer int
+	// Block makes writers of the cache wait for room in the channel, otherwise events are dropped
+	// and counted in Stats.DroppedEvents. The subscriber must not call the cache while writers wait for it.
+	Block bool
+}
+
+func (f EventFilter) match(typ EventType, key interface{}) bool {
+	if f.Types != 0 && f.Types&typ == 0 {
+		return false
+	}
+	if f.KeyPrefix != "" {
+		s, ok := key.(string)
+		return ok && strings.HasPrefix(s, f.KeyPrefix)
+	}
+	return true
+}
+
+type subscriber[K comparable, V any] struct {
+	filter EventFilter
+	events chan Event[K, V]
+	done   chan struct{}
+	once   sync.Once
+}
+
+// hub sends the events of all shards to the subscribers
+type hub[K comparable, V any] struct {
+	lock        sync.RWMutex
+	subscribers map[*subscriber[K, V]]struct{}
+	count       atomic.Int32 // skip building events if nobody subscribes
+}
+
+func newHub[K comparable, V any]() *hub[K, V] {
+	return &hub[K, V]{subscribers: make(map[*subscriber[K, V]]struct{})}
+}
+
+func (h *hub[K, V]) subscribe(filter EventFilter) (<-chan Event[K, V], func()) {
+	if filter.Buffer <= 0 {
+		filter.Buffer = defaultEventBuffer
+	}
+	sub := &subscriber[K, V]{
+		filter: filter,
+		events: make(chan Event[K, V], filter.Buffer),
+		done:   make(chan struct{}),
+	}
+
+	h.lock.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.count.Add(1)
+	h.lock.Unlock()
+	return sub.events, func() { h.unsubscribe(sub) }
+}
+
+// unsubscribe stops sending events to sub and closes its channel
+func (h *hub[K, V]) unsubscribe(sub *subscriber[K, V]) {
+	sub.once.Do(func() {
+		close(sub.done) // wake up writers blocked on sub before taking the lock
+
+		h.lock.Lock()
+		delete(h.subscribers, sub)
+		h.count.Add(-1)
+		h.lock.Unlock()
+		close(sub.events)
+	})
+}
+
+func (h *hub[K, V]) close() {
+	h.lock.RLock()
+	subscribers := make([]*subscriber[K, V], 0, len(h.subscribers))
+	for sub := range h.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	h.lock.RUnlock()
+
+	for _, sub := range subscribers {
+		h.unsubscribe(sub)
+	}
+}
+
+func (h *hub[K, V]) active() bool {
+	return h.count.Load() > 0
+}
+
+// publish sends the event to the subscribers it matches, it returns the number of dropped events
+func (h *hub[K, V]) publish(event Event[K, V]) int64 {
+	var dropped int64
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for sub := range h.subscribers {
+		if !sub.filter.match(event.Type, interface{}(event.Key)) {
+			continue
+		}
+		if sub.filter.Block {
+			select {
+			case sub.events <- event:
+			case <-sub.done:
+			}
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default: // slow subscriber
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,236 @@
+package easycache
+
+import (
+	"container/list"
+	"math/rand"
+)
+
+// EvictionPolicy decides which key is evicted when a shard has No space.
+// Every shard owns its own policy, all methods are called with the shard write lock held.
+type EvictionPolicy[K comparable] interface {
+	// OnAccess is called when an existing key is read or modified
+	OnAccess(key K)
+	// OnInsert is called when a new key is added
+	OnInsert(key K)
+	// OnRemove is called when a key is removed for any RemoveReason
+	OnRemove(key K)
+	// Victim returns the key to evict other than keep, without removing it.
+	// keep is the key being written, the shard evicts until it fits in.
+	Victim(keep K) (K, bool)
+}
+
+type EvictionKind uint32
+
+const (
+	// EvictLRU evicts the least recently used key
+	EvictLRU = EvictionKind(iota)
+	// EvictLFU evicts the least frequently used key, the least recently used one among equals
+	EvictLFU
+	// EvictFIFO evicts the oldest inserted key
+	EvictFIFO
+	// EvictRandom evicts a random key
+	EvictRandom
+	// EvictWTinyLFU admits keys into a segmented lru by their frequency, it resists scans and suits skewed workloads
+	EvictWTinyLFU
+)
+
+func newEvictionPolicy[K comparable, V any](conf CacheConfig[K, V]) EvictionPolicy[K] {
+	if conf.NewEvictionPolicy != nil {
+		return conf.NewEvictionPolicy()
+	}
+
+	switch conf.Eviction {
+	case EvictLFU:
+		return newLFUPolicy[K]()
+	case EvictFIFO:
+		return newFIFOPolicy[K]()
+	case EvictRandom:
+		return newRandomPolicy[K]()
+	case EvictWTinyLFU:
+		return newTinyLFUPolicy(int(conf.Cap), conf.Hasher)
+	default:
+		return newLRUPolicy[K]()
+	}
+}
+
+// lruPolicy: 最新数据放到list的Front，从list的Back淘汰
+type lruPolicy[K comparable] struct {
+	list  *list.List
+	elems map[K]*list.Element
+}
+
+func newLRUPolicy[K comparable]() *lruPolicy[K] {
+	return &lruPolicy[K]{
+		list:  list.New(),
+		elems: make(map[K]*list.Element),
+	}
+}
+
+func (p *lruPolicy[K]) OnAccess(key K) {
+	if ele, ok := p.elems[key]; ok {
+		p.list.MoveToFront(ele)
+	}
+}
+
+func (p *lruPolicy[K]) OnInsert(key K) {
+	p.elems[key] = p.list.PushFront(key)
+}
+
+func (p *lruPolicy[K]) OnRemove(key K) {
+	if ele, ok := p.elems[key]; ok {
+		p.list.Remove(ele)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy[K]) Victim(keep K) (K, bool) {
+	ele := back(p.list, keep)
+	if ele == nil {
+		var zero K
+		return zero, false
+	}
+	return ele.Value.(K), true
+}
+
+// back returns the last element of l which is not keep
+func back[K comparable](l *list.List, keep K) *list.Element {
+	ele := l.Back()
+	if ele != nil && ele.Value.(K) == keep {
+		ele = ele.Prev()
+	}
+	return ele
+}
+
+// fifoPolicy is a lruPolicy which ignores access
+type fifoPolicy[K comparable] struct {
+	*lruPolicy[K]
+}
+
+func newFIFOPolicy[K comparable]() *fifoPolicy[K] {
+	return &fifoPolicy[K]{lruPolicy: newLRUPolicy[K]()}
+}
+
+func (p *fifoPolicy[K]) OnAccess(key K) {}
+
+// lfuPolicy keeps a list of frequency nodes in ascending order, every node holds the keys used freq times,
+// so that access, insert, remove and victim are all O(1)
+type lfuPolicy[K comparable] struct {
+	freqs   *list.List // *lfuNode[K]
+	entries map[K]*lfuEntry[K]
+}
+
+type lfuNode[K comparable] struct {
+	freq uint64
+	keys *list.List // K, most recently used at front
+}
+
+type lfuEntry[K comparable] struct {
+	node *list.Element // in freqs
+	ele  *list.Element // in node.keys
+}
+
+func newLFUPolicy[K comparable]() *lfuPolicy[K] {
+	return &lfuPolicy[K]{
+		freqs:   list.New(),
+		entries: make(map[K]*lfuEntry[K]),
+	}
+}
+
+func (p *lfuPolicy[K]) OnAccess(key K) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	cur := entry.node.Value.(*lfuNode[K])
+	next := entry.node.Next()
+	if next == nil || next.Value.(*lfuNode[K]).freq != cur.freq+1 {
+		next = p.freqs.InsertAfter(&lfuNode[K]{freq: cur.freq + 1, keys: list.New()}, entry.node)
+	}
+	p.unlink(entry)
+	entry.node = next
+	entry.ele = next.Value.(*lfuNode[K]).keys.PushFront(key)
+}
+
+func (p *lfuPolicy[K]) OnInsert(key K) {
+	front := p.freqs.Front()
+	if front == nil || front.Value.(*lfuNode[K]).freq != 1 {
+		front = p.freqs.PushFront(&lfuNode[K]{freq: 1, keys: list.New()})
+	}
+	p.entries[key] = &lfuEntry[K]{
+		node: front,
+		ele:  front.Value.(*lfuNode[K]).keys.PushFront(key),
+	}
+}
+
+func (p *lfuPolicy[K]) OnRemove(key K) {
+	if entry, ok := p.entries[key]; ok {
+		p.unlink(entry)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy[K]) Victim(keep K) (K, bool) {
+	for node := p.freqs.Front(); node != nil; node = node.Next() {
+		if ele := back(node.Value.(*lfuNode[K]).keys, keep); ele != nil {
+			return ele.Value.(K), true
+		}
+	}
+	var zero K
+	return zero, false
+}
+
+// unlink del the key from its frequency node, empty nodes are dropped
+func (p *lfuPolicy[K]) unlink(entry *lfuEntry[K]) {
+	node := entry.node.Value.(*lfuNode[K])
+	node.keys.Remove(entry.ele)
+	if node.keys.Len() == 0 {
+		p.freqs.Remove(entry.node)
+	}
+}
+
+// randomPolicy keeps all keys in a slice, removing swaps the last key into the hole
+type randomPolicy[K comparable] struct {
+	keys    []K
+	indexes map[K]int
+}
+
+func newRandomPolicy[K comparable]() *randomPolicy[K] {
+	return &randomPolicy[K]{
+		indexes: make(map[K]int),
+	}
+}
+
+func (p *randomPolicy[K]) OnAccess(key K) {}
+
+func (p *randomPolicy[K]) OnInsert(key K) {
+	p.indexes[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy[K]) OnRemove(key K) {
+	i, ok := p.indexes[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.indexes[p.keys[i]] = i
+	var zero K
+	p.keys[last] = zero
+	p.keys = p.keys[:last]
+	delete(p.indexes, key)
+}
+
+func (p *randomPolicy[K]) Victim(keep K) (K, bool) {
+	n := len(p.keys)
+	if i, ok := p.indexes[keep]; ok {
+		n-- // pick from the others, keep is swapped with the last one
+		p.keys[i], p.keys[n] = p.keys[n], p.keys[i]
+		p.indexes[p.keys[i]], p.indexes[keep] = i, n
+	}
+	if n == 0 {
+		var zero K
+		return zero, false
+	}
+	return p.keys[rand.Intn(n)], true
+}
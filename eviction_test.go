@@ -0,0 +1,186 @@
+package easycache
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newEvictionCache(t *testing.T, kind EvictionKind) *EasyCache {
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.Cap = 3
+	conf.Eviction = kind
+	cache, err := New(conf)
+	noError(t, err)
+	return cache
+}
+
+func TestEvictLRU(t *testing.T) {
+	t.Parallel()
+
+	cache := newEvictionCache(t, EvictLRU)
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Set("c", 3, 0)
+	cache.Get("a")
+	cache.Set("d", 4, 0) // del b
+
+	assertEqual(t, true, cache.Exists("a"))
+	assertEqual(t, false, cache.Exists("b"))
+}
+
+func TestEvictLFU(t *testing.T) {
+	t.Parallel()
+
+	cache := newEvictionCache(t, EvictLFU)
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Set("c", 3, 0)
+	cache.Get("a")
+	cache.Get("a")
+	cache.Get("b")
+	cache.Set("d", 4, 0) // del c, the only one used once
+	assertEqual(t, false, cache.Exists("c"))
+
+	cache.Get("d")
+	cache.Set("e", 5, 0) // b and d are used twice, del b which is used less recently
+	assertEqual(t, false, cache.Exists("b"))
+	assertEqual(t, true, cache.Exists("a"))
+	assertEqual(t, true, cache.Exists("d"))
+}
+
+func TestEvictFIFO(t *testing.T) {
+	t.Parallel()
+
+	cache := newEvictionCache(t, EvictFIFO)
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Set("c", 3, 0)
+	cache.Get("a")
+	cache.Set("d", 4, 0) // del a, access does not matter
+
+	assertEqual(t, false, cache.Exists("a"))
+	assertEqual(t, true, cache.Exists("b"))
+}
+
+func TestEvictRandom(t *testing.T) {
+	t.Parallel()
+
+	cache := newEvictionCache(t, EvictRandom)
+	defer cache.Close()
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), i, 0)
+		if i%7 == 0 {
+			cache.Delete(strconv.Itoa(i))
+		}
+	}
+	assertEqual(t, 3, cache.Count())
+
+	policy := cache.shards[0].policy.(*randomPolicy[string])
+	assertEqual(t, 3, len(policy.keys))
+	for key, i := range policy.indexes {
+		assertEqual(t, key, policy.keys[i])
+	}
+}
+
+func TestCustomEvictionPolicy(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.Cap = 2
+	conf.Eviction = EvictLFU // ignored
+	conf.NewEvictionPolicy = func() EvictionPolicy[string] {
+		return newFIFOPolicy[string]()
+	}
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	cache.Set("a", 1, time.Hour)
+	cache.Set("b", 2, 0)
+	cache.Get("a")
+	cache.Set("c", 3, 0)
+	assertEqual(t, false, cache.Exists("a"))
+	assertEqual(t, 0, cache.shards[0].expireItems.Len())
+}
+
+// hitRatio replays a zipf trace interleaved with scan bursts, every miss is loaded into the cache.
+// The cache holds about 500 keys, bounded by Cap or by MaxBytes if maxBytes is set.
+func hitRatio(kind EvictionKind, maxBytes bool) float64 {
+	conf := DefaultConfig()
+	conf.Shards = 1
+	conf.Cap = 500
+	if maxBytes {
+		conf.Cap = 0
+		conf.MaxBytes = 500 * 16 // keys are 5-7 bytes and values 10
+	}
+	conf.Eviction = kind
+	cache, _ := New(conf)
+	defer cache.Close()
+
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 50000)
+	hits, total := 0, 0
+	scan := 1000000
+	for i := 0; i < 200000; i++ {
+		var key string
+		if i%10000 < 1000 { // scan burst, never used again
+			key = strconv.Itoa(scan)
+			scan++
+		} else {
+			key = strconv.FormatUint(zipf.Uint64(), 10)
+		}
+
+		total++
+		if _, err := cache.Get(key); err == nil {
+			hits++
+		} else {
+			cache.Set(key, "0123456789", 0)
+		}
+	}
+	return float64(hits) / float64(total)
+}
+
+func TestEvictWTinyLFUHitRatio(t *testing.T) {
+	t.Parallel()
+
+	for _, maxBytes := range []bool{false, true} {
+		lru := hitRatio(EvictLRU, maxBytes)
+		tinyLFU := hitRatio(EvictWTinyLFU, maxBytes)
+		t.Logf("max bytes %v hit ratio lru: %.4f w-tinylfu: %.4f", maxBytes, lru, tinyLFU)
+		if tinyLFU <= lru*1.1 {
+			t.Errorf("max bytes %v: w-tinylfu hit ratio %.4f is not better than lru %.4f", maxBytes, tinyLFU, lru)
+		}
+	}
+}
+
+func TestEvictWTinyLFU(t *testing.T) {
+	t.Parallel()
+
+	cache := newEvictionCache(t, EvictWTinyLFU)
+	defer cache.Close()
+	cache.Set("a", 1, 0)
+	cache.Set("b", 2, 0)
+	cache.Set("c", 3, 0)
+	for i := 0; i < 5; i++ {
+		cache.Get("a")
+		cache.Get("b")
+	}
+
+	// a scan does not flush the popular keys
+	for i := 0; i < 10; i++ {
+		cache.Set("scan"+strconv.Itoa(i), i, 0)
+	}
+	assertEqual(t, 3, cache.Count())
+	assertEqual(t, true, cache.Exists("a"))
+	assertEqual(t, true, cache.Exists("b"))
+
+	policy := cache.shards[0].policy.(*tinyLFUPolicy[string])
+	assertEqual(t, 3, len(policy.entries))
+	assertEqual(t, 3, policy.window.Len()+policy.probation.Len()+policy.protected.Len())
+}
@@ -76,6 +76,17 @@ func main() {
 	// close cache
 	cache.Close()
 
+	// typed cache: no type assertion needed
+	typedCache, err := easycache.NewCache(easycache.DefaultCacheConfig[string, *MyData]())
+	if err != nil {
+		return
+	}
+	typedCache.Set("easy_key_typed", &MyData{Name: "小刚", Sex: 1, Score: 98}, 0)
+	if data, err := typedCache.Get("easy_key_typed"); err == nil {
+		fmt.Println(data.Name)
+	}
+	typedCache.Close()
+
 	//signal block
 	sigusr1 := make(chan os.Signal, 1)
 	signal.Notify(sigusr1, syscall.SIGTERM)
@@ -0,0 +1,60 @@
+package easycache
+
+import "container/heap"
+
+// expireHeap is a min-heap of the items with a lifeSpan, ordered by expiration time.
+// expireCleanup only pops the expired items from the top, so it never visits a key which is still alive.
+type expireHeap[K comparable, V any] []*cacheItem[K, V]
+
+func (h expireHeap[K, V]) Len() int { return len(h) }
+
+func (h expireHeap[K, V]) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+
+func (h expireHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expireIndex = i
+	h[j].expireIndex = j
+}
+
+func (h *expireHeap[K, V]) Push(x interface{}) {
+	item := x.(*cacheItem[K, V])
+	item.expireIndex = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expireHeap[K, V]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil // avoid memory leak
+	item.expireIndex = -1
+	*h = old[:n-1]
+	return item
+}
+
+// peek returns the item which expires first
+func (h expireHeap[K, V]) peek() *cacheItem[K, V] {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0]
+}
+
+// update keeps the item in the right place after its lifeSpan changed
+func (h *expireHeap[K, V]) update(item *cacheItem[K, V]) {
+	switch {
+	case item.expireIndex < 0 && item.lifeSpan > 0:
+		heap.Push(h, item)
+	case item.expireIndex >= 0 && item.lifeSpan > 0:
+		heap.Fix(h, item.expireIndex)
+	case item.expireIndex >= 0:
+		h.remove(item)
+	}
+}
+
+// remove del the item if it is in the heap
+func (h *expireHeap[K, V]) remove(item *cacheItem[K, V]) {
+	if item.expireIndex >= 0 {
+		heap.Remove(h, item.expireIndex)
+	}
+}
@@ -6,3 +6,17 @@ package easycache
 type Hasher interface {
 	Sum64(string) uint64
 }
+
+// KeyHasher is the generic form of Hasher, it maps keys of type K to unsigned 64bit integers.
+// Every Hasher is a KeyHasher[string].
+type KeyHasher[K comparable] interface {
+	Sum64(K) uint64
+}
+
+// KeyHasherFunc is an adapter to allow the use of ordinary functions as KeyHasher.
+type KeyHasherFunc[K comparable] func(K) uint64
+
+// Sum64 calls f(key).
+func (f KeyHasherFunc[K]) Sum64(key K) uint64 {
+	return f(key)
+}
@@ -0,0 +1,112 @@
+package easycache
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultJanitors = 1
+)
+
+// janitor cleans expired keys for a group of shards with a single goroutine and timer
+type janitor[K comparable, V any] struct {
+	shards []*cacheShard[K, V]
+
+	// unix nano of the next cleanup, math.MaxInt64 while cleaning
+	next atomic.Int64
+	// add notify, buffered so that shards never block or spawn goroutines
+	wakeup chan struct{}
+
+	logger    Logger
+	isVerbose bool
+	// close
+	close chan struct{}
+}
+
+func newJanitor[K comparable, V any](logger Logger, isVerbose bool, close chan struct{}) *janitor[K, V] {
+	j := &janitor[K, V]{
+		wakeup:    make(chan struct{}, 1),
+		logger:    logger,
+		isVerbose: isVerbose,
+		close:     close,
+	}
+	j.next.Store(time.Now().Add(defaultInternal).UnixNano())
+	return j
+}
+
+// notify wakes up the janitor if expireAt is earlier than the next cleanup
+func (j *janitor[K, V]) notify(expireAt time.Time) {
+	at := expireAt.UnixNano()
+	for {
+		next := j.next.Load()
+		if at >= next {
+			return
+		}
+		if j.next.CompareAndSwap(next, at) {
+			break
+		}
+	}
+
+	select {
+	case j.wakeup <- struct{}{}:
+	default: // already notified
+	}
+}
+
+/*
+1.当定时器到期，执行过期清理
+2.当新增的key比下一次清理更早过期，通过wakeup触发执行
+*/
+func (j *janitor[K, V]) run() {
+	timer := time.NewTimer(defaultInternal)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-j.wakeup: // 立即触发
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-j.close: // stop goroutine
+			for _, shard := range j.shards {
+				if j.isVerbose {
+					j.logger.Printf("[shard %d] flush..", shard.id)
+				}
+				shard.flush() // free
+			}
+			return
+		}
+
+		// keys added while cleaning always notify, they may belong to an already cleaned shard
+		j.next.Store(math.MaxInt64)
+
+		// 记录下一次定时器的最小间隔（目的：key过期了，尽快删除）
+		smallestInternal := defaultInternal
+		for _, shard := range j.shards {
+			shard.lock.Lock()
+			if d := shard.cleanup(time.Now()); d < smallestInternal {
+				smallestInternal = d
+			}
+			shard.lock.Unlock()
+		}
+
+		next := time.Now().Add(smallestInternal).UnixNano()
+		for {
+			cur := j.next.Load()
+			if cur <= next { // notified with an earlier key while cleaning
+				smallestInternal = time.Duration(cur - time.Now().UnixNano())
+				break
+			}
+			if j.next.CompareAndSwap(cur, next) {
+				break
+			}
+		}
+		timer.Reset(smallestInternal)
+	}
+}
@@ -0,0 +1,85 @@
+package easycache
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Loader loads the value of a key which is not in the cache
+type Loader[K comparable, V any] interface {
+	Get(K) (V, error)
+}
+
+// LoaderFunc is an adapter to allow the use of ordinary functions as Loader.
+type LoaderFunc[K comparable, V any] func(K) (V, error)
+
+func (l LoaderFunc[K, V]) Get(key K) (V, error) {
+	return l(key)
+}
+
+// LoaderWithContext loads the value of a key which is not in the cache, it should give up once ctx is done
+type LoaderWithContext[K comparable, V any] interface {
+	Load(ctx context.Context, key K) (V, error)
+}
+
+// LoaderWithContextFunc is an adapter to allow the use of ordinary functions as LoaderWithContext.
+type LoaderWithContextFunc[K comparable, V any] func(context.Context, K) (V, error)
+
+func (l LoaderWithContextFunc[K, V]) Load(ctx context.Context, key K) (V, error) {
+	return l(ctx, key)
+}
+
+// NoExpiration is the lifeSpan returned by a TTLLoader for a value which never expires
+const NoExpiration = time.Duration(math.MaxInt64)
+
+// TTLLoader loads the value of a key together with its lifeSpan, so that the freshness is decided by the data source
+// (e.g. Cache-Control of a http response). A lifeSpan <= 0 returns the value without caching it (max-age=0, no-store),
+// NoExpiration caches it forever.
+type TTLLoader[K comparable, V any] interface {
+	LoadWithTTL(ctx context.Context, key K) (V, time.Duration, error)
+}
+
+// TTLLoaderFunc is an adapter to allow the use of ordinary functions as TTLLoader.
+type TTLLoaderFunc[K comparable, V any] func(context.Context, K) (V, time.Duration, error)
+
+func (l TTLLoaderFunc[K, V]) LoadWithTTL(ctx context.Context, key K) (V, time.Duration, error) {
+	return l(ctx, key)
+}
+
+// loaderWithoutContext adapts a Loader, which can not be cancelled
+type loaderWithoutContext[K comparable, V any] struct {
+	Loader[K, V]
+}
+
+func (l loaderWithoutContext[K, V]) Load(ctx context.Context, key K) (V, error) {
+	return l.Get(key)
+}
+
+// loaderWithTTL adapts a LoaderWithContext, the lifeSpan is decided by the caller and 0 never expires
+type loaderWithTTL[K comparable, V any] struct {
+	loader   LoaderWithContext[K, V]
+	lifeSpan time.Duration
+}
+
+func (l loaderWithTTL[K, V]) LoadWithTTL(ctx context.Context, key K) (V, time.Duration, error) {
+	value, err := l.loader.Load(ctx, key)
+	if l.lifeSpan <= 0 {
+		return value, NoExpiration, err
+	}
+	return value, l.lifeSpan, err
+}
+
+// detachedContext keeps the values of its parent but is never cancelled,
+// so that a load shared by many callers outlives the caller which started it
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,39 @@
+package easycache
+
+import "sync/atomic"
+
+const (
+	readBufferSize = 64 // must be power of two
+	readBufferMask = readBufferSize - 1
+)
+
+// readBuffer records the items hit by get, so that the lru list is only touched with the write lock held.
+// It is lossy: when readers are faster than draining, the oldest records are overwritten,
+// which only makes the lru order a little less precise.
+type readBuffer[K comparable, V any] struct {
+	head  atomic.Uint64 // next slot to write
+	tail  atomic.Uint64 // next slot to drain
+	slots [readBufferSize]atomic.Pointer[cacheItem[K, V]]
+}
+
+// add records an access, returns true if the buffer is full and should be drained
+func (b *readBuffer[K, V]) add(item *cacheItem[K, V]) bool {
+	head := b.head.Add(1)
+	b.slots[(head-1)&readBufferMask].Store(item)
+	return head-b.tail.Load() >= readBufferSize
+}
+
+// drain applies f to the recorded items from oldest to newest, must hold the write lock
+func (b *readBuffer[K, V]) drain(f func(item *cacheItem[K, V])) {
+	head := b.head.Load()
+	tail := b.tail.Load()
+	if head-tail > readBufferSize { // overwritten
+		tail = head - readBufferSize
+	}
+	for ; tail < head; tail++ {
+		if item := b.slots[tail&readBufferMask].Swap(nil); item != nil {
+			f(item)
+		}
+	}
+	b.tail.Store(head)
+}
@@ -0,0 +1,184 @@
+package easycache
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotVersion         = 1
+	defaultSnapshotInterval = time.Minute
+)
+
+// Encoder writes values to a stream, gob.Encoder and json.Encoder are Encoders
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder reads values written by the Encoder of the same Codec
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// Codec encodes the k/v of snapshots
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// GobCodec is the default Codec. Concrete types stored in interface{} values must be registered with gob.Register
+var GobCodec Codec = gobCodec{}
+
+// JSONCodec encodes snapshots as JSON, interface{} values are decoded as the json package does (float64, map[string]interface{}...)
+var JSONCodec Codec = jsonCodec{}
+
+type gobCodec struct{}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+func (gobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+
+type snapshotHeader struct {
+	Version int
+	SavedAt time.Time
+}
+
+// snapshotEntry is a k/v in a snapshot, the deadline is absolute so that the time the cache was down counts
+type snapshotEntry[K comparable, V any] struct {
+	Key      K
+	Value    V
+	ExpireAt time.Time // zero if it never expires
+	LifeSpan time.Duration
+	Sliding  bool
+}
+
+// SaveSnapshot writes all the k/v and their deadlines to w with Config.Codec.
+// Shards are copied one by one under their lock, so the snapshot is consistent per shard.
+func (c *Cache[K, V]) SaveSnapshot(w io.Writer) error {
+	enc := c.codec().NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion, SavedAt: time.Now()}); err != nil {
+		return err
+	}
+	for _, shard := range c.shards {
+		for _, entry := range shard.snapshot(time.Now(), nil) {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot sets the k/v saved by SaveSnapshot with their remaining TTL, the expired ones are skipped
+func (c *Cache[K, V]) LoadSnapshot(r io.Reader) error {
+	dec := c.codec().NewDecoder(r)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unknown snapshot version %d", header.Version)
+	}
+
+	for {
+		var entry snapshotEntry[K, V]
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hashedKey := c.hash.Sum64(entry.Key)
+		shard := c.getShard(hashedKey)
+		if err := shard.restore(entry, time.Now()); err != nil && !errors.Is(err, ErrEntryTooLarge) {
+			return err
+		}
+	}
+}
+
+func (c *Cache[K, V]) codec() Codec {
+	if c.conf.Codec != nil {
+		return c.conf.Codec
+	}
+	return GobCodec
+}
+
+// saveSnapshotFile writes a snapshot to a temporary file and renames it to Config.SnapshotPath.
+// The last one is saved by Close, the shards are flushed after it so later saves are skipped.
+func (c *Cache[K, V]) saveSnapshotFile(last bool) error {
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+	if c.snapshotDone {
+		return nil
+	}
+	c.snapshotDone = last
+
+	// a unique name, other caches may save to the same path
+	f, err := os.CreateTemp(filepath.Dir(c.conf.SnapshotPath), filepath.Base(c.conf.SnapshotPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	err = c.SaveSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.conf.SnapshotPath)
+}
+
+// loadSnapshotFile loads Config.SnapshotPath, a missing file is an empty cache
+func (c *Cache[K, V]) loadSnapshotFile() error {
+	f, err := os.Open(c.conf.SnapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.LoadSnapshot(bufio.NewReader(f))
+}
+
+// snapshotLoop saves a snapshot every Config.SnapshotInterval until the cache is closed
+func (c *Cache[K, V]) snapshotLoop() {
+	interval := c.conf.SnapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	logger := newLogger(c.conf.Logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.saveSnapshotFile(false); err != nil {
+				logger.Printf("save snapshot %s: %v\n", c.conf.SnapshotPath, err)
+			}
+		case <-c.close:
+			return
+		}
+	}
+}
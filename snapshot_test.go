@@ -0,0 +1,157 @@
+package easycache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type snapshotUser struct {
+	Name string
+	Age  int
+}
+
+func init() {
+	gob.Register(snapshotUser{})
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := New(DefaultConfig())
+	defer cache.Close()
+	cache.Set("persist", "value", 0)
+	cache.Set("ttl", snapshotUser{"bob", 20}, time.Minute)
+	cache.Set("expired", "value", 20*time.Millisecond)
+	cache.SetSliding("session", []byte("data"), time.Hour)
+	time.Sleep(30 * time.Millisecond)
+
+	var buf bytes.Buffer
+	noError(t, cache.SaveSnapshot(&buf))
+
+	restored, _ := New(DefaultConfig())
+	defer restored.Close()
+	noError(t, restored.LoadSnapshot(&buf))
+
+	assertEqual(t, 3, restored.Count())
+	assertEqual(t, "value", mustGet(t, restored, "persist"))
+	assertEqual(t, snapshotUser{"bob", 20}, mustGet(t, restored, "ttl"))
+	assertEqual(t, []byte("data"), mustGet(t, restored, "session"))
+	assertEqual(t, false, restored.Exists("expired"))
+
+	// remaining TTLs
+	ttl, _ := restored.TTL("persist")
+	assertEqual(t, time.Duration(0), ttl)
+	ttl, _ = restored.TTL("ttl")
+	assertEqual(t, true, ttl > 59*time.Second && ttl < time.Minute-20*time.Millisecond)
+	ttl, _ = restored.TTL("session")
+	assertEqual(t, true, ttl > 59*time.Minute)
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultCacheConfig[string, int]()
+	conf.Codec = JSONCodec
+	cache, _ := NewCache[string, int](conf)
+	defer cache.Close()
+	cache.Set("a", 1, time.Minute)
+
+	var buf bytes.Buffer
+	noError(t, cache.SaveSnapshot(&buf))
+	restored, _ := NewCache[string, int](conf)
+	defer restored.Close()
+	noError(t, restored.LoadSnapshot(&buf))
+	val, err := restored.Get("a")
+	noError(t, err)
+	assertEqual(t, 1, val)
+
+	// interface{} values are decoded as the json package does
+	econf := DefaultConfig()
+	econf.Codec = JSONCodec
+	ecache, _ := New(econf)
+	defer ecache.Close()
+	ecache.Set("a", 1, 0)
+	buf.Reset()
+	noError(t, ecache.SaveSnapshot(&buf))
+	erestored, _ := New(econf)
+	defer erestored.Close()
+	noError(t, erestored.LoadSnapshot(&buf))
+	assertEqual(t, float64(1), mustGet(t, erestored, "a"))
+}
+
+func TestSnapshotPath(t *testing.T) {
+	t.Parallel()
+
+	conf := DefaultConfig()
+	conf.SnapshotPath = filepath.Join(t.TempDir(), "cache.snapshot")
+	conf.SnapshotInterval = 10 * time.Millisecond
+
+	cache, err := New(conf)
+	noError(t, err)
+	cache.Set("a", "1", 0)
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(conf.SnapshotPath) // periodic snapshot
+	noError(t, err)
+
+	cache.Set("b", "2", 0)
+	noError(t, cache.Close())
+
+	restored, err := New(conf)
+	noError(t, err)
+	assertEqual(t, "1", mustGet(t, restored, "a"))
+	assertEqual(t, "2", mustGet(t, restored, "b"))
+	noError(t, restored.Close()) // before it saves over the broken file
+
+	// a broken file fails
+	noError(t, os.WriteFile(conf.SnapshotPath, []byte("broken"), 0644))
+	broken, err := New(conf)
+	if err == nil {
+		broken.Close()
+		t.Fatal("expect an error for a broken snapshot")
+	}
+}
+
+type recordLogger struct {
+	lock sync.Mutex
+	logs []string
+}
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func TestSnapshotPathShared(t *testing.T) {
+	t.Parallel()
+
+	logger := &recordLogger{}
+	conf := DefaultConfig()
+	conf.SnapshotPath = filepath.Join(t.TempDir(), "cache.snapshot")
+	conf.SnapshotInterval = time.Millisecond
+	conf.Logger = logger
+
+	// the temporary files of two caches do not collide
+	c1, err := New(conf)
+	noError(t, err)
+	c2, err := New(conf)
+	noError(t, err)
+	c1.Set("a", "1", 0)
+	c2.Set("a", "2", 0)
+	time.Sleep(50 * time.Millisecond)
+	noError(t, c1.Close())
+	noError(t, c2.Close())
+	assertEqual(t, 0, len(logger.logs))
+
+	// no periodic snapshot of the flushed shards after Close
+	restored, err := New(conf)
+	noError(t, err)
+	defer restored.Close()
+	assertEqual(t, "2", mustGet(t, restored, "a"))
+}
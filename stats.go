@@ -0,0 +1,126 @@
+package easycache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a cache or a single shard
+type Stats struct {
+	Hits   int64
+	Misses int64
+	Sets   int64
+
+	// removed keys by RemoveReason
+	Expired int64
+	NoSpace int64
+	Deleted int64
+
+	// Loader calls of GetIfNotExist
+	LoadSuccess int64
+	LoadFailure int64
+	LoadTime    time.Duration // cumulative
+
+	// RemovalEvents dropped by the async dispatcher and Events dropped for slow subscribers
+	DroppedEvents int64
+}
+
+// Removed returns the number of keys removed for reason
+func (s Stats) Removed(reason RemoveReason) int64 {
+	switch reason {
+	case Expired:
+		return s.Expired
+	case NoSpace:
+		return s.NoSpace
+	case Deleted:
+		return s.Deleted
+	}
+	return 0
+}
+
+// HitRatio returns Hits/(Hits+Misses)
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s *Stats) add(other Stats) {
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.Sets += other.Sets
+	s.Expired += other.Expired
+	s.NoSpace += other.NoSpace
+	s.Deleted += other.Deleted
+	s.LoadSuccess += other.LoadSuccess
+	s.LoadFailure += other.LoadFailure
+	s.LoadTime += other.LoadTime
+	s.DroppedEvents += other.DroppedEvents
+}
+
+// shardStats are updated atomically, so that read paths holding the read lock can count too
+type shardStats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	sets   atomic.Int64
+
+	expired atomic.Int64
+	noSpace atomic.Int64
+	deleted atomic.Int64
+
+	loadSuccess atomic.Int64
+	loadFailure atomic.Int64
+	loadTime    atomic.Int64
+
+	droppedEvents atomic.Int64
+}
+
+func (s *shardStats) removed(reason RemoveReason) {
+	switch reason {
+	case Expired:
+		s.expired.Add(1)
+	case NoSpace:
+		s.noSpace.Add(1)
+	case Deleted:
+		s.deleted.Add(1)
+	}
+}
+
+func (s *shardStats) load(start time.Time, err error) {
+	s.loadTime.Add(int64(time.Since(start)))
+	if err != nil {
+		s.loadFailure.Add(1)
+	} else {
+		s.loadSuccess.Add(1)
+	}
+}
+
+func (s *shardStats) snapshot() Stats {
+	return Stats{
+		Hits:        s.hits.Load(),
+		Misses:      s.misses.Load(),
+		Sets:        s.sets.Load(),
+		Expired:     s.expired.Load(),
+		NoSpace:     s.noSpace.Load(),
+		Deleted:     s.deleted.Load(),
+		LoadSuccess: s.loadSuccess.Load(),
+		LoadFailure: s.loadFailure.Load(),
+		LoadTime:    time.Duration(s.loadTime.Load()),
+
+		DroppedEvents: s.droppedEvents.Load(),
+	}
+}
+
+func (s *shardStats) reset() {
+	s.hits.Store(0)
+	s.misses.Store(0)
+	s.sets.Store(0)
+	s.expired.Store(0)
+	s.noSpace.Store(0)
+	s.deleted.Store(0)
+	s.loadSuccess.Store(0)
+	s.loadFailure.Store(0)
+	s.loadTime.Store(0)
+	s.droppedEvents.Store(0)
+}
@@ -0,0 +1,252 @@
+package easycache
+
+import (
+	"container/list"
+)
+
+const (
+	windowPercent    = 1  // admission window takes 1% of the cap
+	protectedPercent = 80 // protected segment takes 80% of the main lru
+	sketchDepth      = 4
+	sketchMaxCount   = 15 // 4 bits counter, like caffeine
+	sketchResetRatio = 10 // counters are halved after sketchResetRatio*cap increments
+)
+
+// countMinSketch estimates how often a key is used, all counters are halved periodically
+// so that keys which used to be popular age out
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions uint64
+	resetAt   uint64
+}
+
+func newCountMinSketch(cap int) *countMinSketch {
+	width := 16
+	for width < cap {
+		width <<= 1
+	}
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		resetAt: uint64(cap * sketchResetRatio),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index spreads the hash differently for every row (shards already consumed the low bits of the hash)
+func (s *countMinSketch) index(hash uint64, row int) uint64 {
+	hash += uint64(row+1) * 0x9e3779b97f4a7c15
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	return (hash ^ (hash >> 31)) & s.mask
+}
+
+func (s *countMinSketch) increment(hash uint64) {
+	added := false
+	for i := range s.rows {
+		idx := s.index(hash, i)
+		if s.rows[i][idx] < sketchMaxCount {
+			s.rows[i][idx]++
+			added = true
+		}
+	}
+	if added {
+		s.additions++
+		if s.additions >= s.resetAt {
+			s.reset()
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(hash uint64) uint8 {
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(hash, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// raise sets the counters of hash to count at least
+func (s *countMinSketch) raise(hash uint64, count uint8) {
+	for i := range s.rows {
+		if idx := s.index(hash, i); s.rows[i][idx] < count {
+			s.rows[i][idx] = count
+		}
+	}
+}
+
+// reset halves all counters (aging)
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+type tinyLFUSegment uint8
+
+const (
+	segmentWindow = tinyLFUSegment(iota)
+	segmentProbation
+	segmentProtected
+)
+
+type tinyLFUEntry[K comparable] struct {
+	segment tinyLFUSegment
+	ele     *list.Element
+}
+
+// tinyLFUPolicy is W-TinyLFU: new keys enter a small window lru, the key pushed out of the window
+// only enters the segmented main lru if the sketch says it is used more often than the main victim.
+// See https://arxiv.org/abs/1512.00727
+type tinyLFUPolicy[K comparable] struct {
+	hasher KeyHasher[K]
+	sketch *countMinSketch
+
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	entries   map[K]*tinyLFUEntry[K]
+
+	cap          int
+	windowCap    int
+	protectedCap int
+	growing      bool // the number of keys is unknown, the cap doubles as they grow
+}
+
+func newTinyLFUPolicy[K comparable](cap int, hasher KeyHasher[K]) *tinyLFUPolicy[K] {
+	p := &tinyLFUPolicy[K]{
+		hasher:    hasher,
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		entries:   make(map[K]*tinyLFUEntry[K]),
+	}
+	if cap <= 0 { // only limited by MaxBytes
+		cap = defaultCap
+		p.growing = true
+	}
+	p.resize(cap)
+	return p
+}
+
+// resize sizes the sketch and the segments for cap keys, the frequencies of the cached keys are kept
+func (p *tinyLFUPolicy[K]) resize(cap int) {
+	old := p.sketch
+	p.sketch = newCountMinSketch(cap)
+	if old != nil {
+		for key := range p.entries {
+			hash := p.hasher.Sum64(key)
+			p.sketch.raise(hash, old.estimate(hash))
+		}
+	}
+
+	p.cap = cap
+	p.windowCap = cap * windowPercent / 100
+	if p.windowCap < 1 {
+		p.windowCap = 1
+	}
+	p.protectedCap = (cap - p.windowCap) * protectedPercent / 100
+}
+
+func (p *tinyLFUPolicy[K]) OnAccess(key K) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.sketch.increment(p.hasher.Sum64(key))
+
+	switch entry.segment {
+	case segmentWindow:
+		p.window.MoveToFront(entry.ele)
+	case segmentProtected:
+		p.protected.MoveToFront(entry.ele)
+	case segmentProbation: // promote
+		p.probation.Remove(entry.ele)
+		entry.segment = segmentProtected
+		entry.ele = p.protected.PushFront(key)
+		if p.protected.Len() > p.protectedCap { // demote
+			p.move(p.protected.Back(), segmentProbation)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy[K]) OnInsert(key K) {
+	if p.growing && len(p.entries) >= p.cap { // amortized O(1)
+		p.resize(p.cap * 2)
+	}
+	p.sketch.increment(p.hasher.Sum64(key))
+	p.entries[key] = &tinyLFUEntry[K]{
+		segment: segmentWindow,
+		ele:     p.window.PushFront(key),
+	}
+	if p.window.Len() > p.windowCap { // not full yet, main lru takes it
+		p.move(p.window.Back(), segmentProbation)
+	}
+}
+
+func (p *tinyLFUPolicy[K]) OnRemove(key K) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.segmentList(entry.segment).Remove(entry.ele)
+	delete(p.entries, key)
+}
+
+// Victim picks between the window candidate and the main victim, the one used less often is evicted.
+// When the candidate wins it moves to the main lru right away.
+func (p *tinyLFUPolicy[K]) Victim(keep K) (K, bool) {
+	mainVictim := back(p.probation, keep)
+	if mainVictim == nil {
+		mainVictim = back(p.protected, keep)
+	}
+	candidate := back(p.window, keep)
+	if p.window.Len() < p.windowCap || candidate == nil {
+		candidate = nil // window has room for the new key
+	}
+
+	switch {
+	case candidate == nil && mainVictim == nil:
+		var zero K
+		return zero, false
+	case candidate == nil:
+		return mainVictim.Value.(K), true
+	case mainVictim == nil:
+		return candidate.Value.(K), true
+	}
+
+	candidateKey, victimKey := candidate.Value.(K), mainVictim.Value.(K)
+	if p.sketch.estimate(p.hasher.Sum64(candidateKey)) > p.sketch.estimate(p.hasher.Sum64(victimKey)) {
+		p.move(candidate, segmentProbation)
+		return victimKey, true
+	}
+	return candidateKey, true
+}
+
+// move the key of ele to the front of segment
+func (p *tinyLFUPolicy[K]) move(ele *list.Element, segment tinyLFUSegment) {
+	key := ele.Value.(K)
+	entry := p.entries[key]
+	p.segmentList(entry.segment).Remove(ele)
+	entry.segment = segment
+	entry.ele = p.segmentList(segment).PushFront(key)
+}
+
+func (p *tinyLFUPolicy[K]) segmentList(segment tinyLFUSegment) *list.List {
+	switch segment {
+	case segmentWindow:
+		return p.window
+	case segmentProbation:
+		return p.probation
+	default:
+		return p.protected
+	}
+}
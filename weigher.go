@@ -0,0 +1,22 @@
+package easycache
+
+// Weigher returns the weight of a k/v, usually its size in bytes
+type Weigher[K comparable, V any] func(key K, value V) int64
+
+// defaultWeigher weighs string and []byte by their length, other values weigh 1
+func defaultWeigher[K comparable, V any](key K, value V) int64 {
+	var weight int64
+	if k, ok := interface{}(key).(string); ok {
+		weight += int64(len(k))
+	}
+
+	switch v := interface{}(value).(type) {
+	case string:
+		weight += int64(len(v))
+	case []byte:
+		weight += int64(len(v))
+	default:
+		weight++
+	}
+	return weight
+}